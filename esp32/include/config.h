@@ -0,0 +1,14 @@
+#pragma once
+
+// Hardware parameters, refreshed from the server on every wake
+struct DeviceConfig {
+    int lockedAngle;
+    int unlockedAngle;
+    int servoDwellMs;
+    int powerOnDelayMs;
+    int wifiTimeoutMs;
+    int heartbeatIntervalS;
+};
+
+// Used until the server has been reached at least once
+#define DEFAULT_DEVICE_CONFIG { 89, 1, 1000, 100, 10000, 3600 }
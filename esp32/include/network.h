@@ -1,8 +1,28 @@
 #include <WiFi.h>
 
+#include "config.h"
+
 // Asynchronously begin connecting to WiFi
 void beginConnectToWiFi();
 
 bool requestLockboxAccess(byte uuid[]);
 
 void requestCreateNewCard(byte uuid[]);
+
+// Report device health to the server
+void sendHeartbeat(const char *wakeReason, byte rfidVersion);
+
+// Refresh config from the server. Returns false and leaves config
+// untouched if it is unchanged or the server could not be reached.
+bool fetchDeviceConfig(DeviceConfig *config, char *etag, size_t etagLen);
+
+// Ask the server for a pending remote unlock. Returns true and fills
+// commandUUID if the door should be opened.
+bool checkInForUnlock(char *commandUUID, size_t commandUUIDLen);
+
+// Tell the server whether a remote unlock was carried out
+void acknowledgeUnlock(const char *commandUUID, bool unlocked);
+
+// Report a door or reader event. type is one of "unlocked", "relocked",
+// "button_wake" or "reader_error".
+void reportDeviceEvent(const char *type, const char *detail);
@@ -4,3 +4,7 @@
 #define SERVO_PIN     GPIO_NUM_6
 #define MOSFET_PIN    GPIO_NUM_5
 #define BUZZER_PIN    GPIO_NUM_7
+
+// Uncomment if a battery sense divider is wired to an ADC pin
+// #define BATTERY_ADC_PIN       GPIO_NUM_0
+// #define BATTERY_DIVIDER_RATIO 2
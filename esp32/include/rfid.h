@@ -1,7 +1,13 @@
+// doRFIDLogic error codes
+#define RFID_ERR_CARD    -1 // Card could not be read, authenticated or written
+#define RFID_ERR_NO_CARD -2 // Nothing was held up to the reader
+#define RFID_ERR_READER  -3 // Reader is not responding
+
 struct RFIDResult {
     int err;
     bool isNew;
     byte uuid[16];
+    byte readerVersion;
 };
 
 RFIDResult doRFIDLogic();
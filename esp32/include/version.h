@@ -0,0 +1 @@
+#define FIRMWARE_VERSION "0.3.0"
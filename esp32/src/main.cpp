@@ -8,6 +8,8 @@
 #include "pins.h"
 #include "rfid.h"
 #include "network.h"
+#include "version.h"
+#include "config.h"
 
 MFRC522 mfrc522(SS, RC522_RST_PIN);
 MFRC522::MIFARE_Key mifareKey;
@@ -15,6 +17,45 @@ MFRC522::MIFARE_Key mifareKey;
 Servo servo;
 RTC_DATA_ATTR volatile bool isDoorLocked = false;
 
+// Last RFID reader version seen, reported on wakes that skip the reader
+RTC_DATA_ATTR byte lastRFIDVersion = 0x00;
+
+// Last configuration fetched from the server, and its ETag
+RTC_DATA_ATTR DeviceConfig deviceConfig = DEFAULT_DEVICE_CONFIG;
+RTC_DATA_ATTR char deviceConfigETag[72] = "";
+
+// Power up the servo and open the door
+void unlockDoor() {
+    digitalWrite(MOSFET_PIN, HIGH);
+    delay(deviceConfig.powerOnDelayMs);
+
+    servo.attach(SERVO_PIN);
+    servo.write(deviceConfig.unlockedAngle);
+    delay(deviceConfig.servoDwellMs);
+    isDoorLocked = false;
+
+    digitalWrite(MOSFET_PIN, LOW);
+}
+
+// Sleep until the button is pressed or the next heartbeat is due
+void goToSleep() {
+    esp_sleep_enable_timer_wakeup(deviceConfig.heartbeatIntervalS * 1000000ULL);
+    esp_deep_sleep_start();
+}
+
+// Wait up to timeoutMs for WiFi to connect
+bool waitForWiFi(unsigned long timeoutMs) {
+    unsigned long start = millis();
+    while (WiFi.status() != WL_CONNECTED) {
+        if (millis() - start > timeoutMs) {
+            return false;
+        }
+        Serial.print(".");
+        delay(50);
+    }
+    return true;
+}
+
 void setup() {
     // Configure pins
     pinMode(BUZZER_PIN, OUTPUT);
@@ -27,31 +68,56 @@ void setup() {
     Serial.println("Starting...");
 
     // Determine if we woke up from a button press
-    bool wasButtonPressed = esp_sleep_get_wakeup_cause() == ESP_SLEEP_WAKEUP_GPIO;
+    esp_sleep_wakeup_cause_t wakeCause = esp_sleep_get_wakeup_cause();
+    bool wasButtonPressed = wakeCause == ESP_SLEEP_WAKEUP_GPIO;
     if (!wasButtonPressed) {
+        // Send a heartbeat and refresh config, then go back to sleep
+        beginConnectToWiFi();
+        if (waitForWiFi(deviceConfig.wifiTimeoutMs)) {
+            const char *wakeReason = wakeCause == ESP_SLEEP_WAKEUP_TIMER ? "timer" : "power_on";
+            sendHeartbeat(wakeReason, lastRFIDVersion);
+            fetchDeviceConfig(&deviceConfig, deviceConfigETag, sizeof(deviceConfigETag));
+
+            // Open the door if it was requested from the dashboard
+            char commandUUID[40];
+            if (checkInForUnlock(commandUUID, sizeof(commandUUID))) {
+                unlockDoor();
+                reportDeviceEvent("unlocked", "remote");
+                acknowledgeUnlock(commandUUID, true);
+            }
+        }
+        WiFi.disconnect(true, false);
+
         // Go to sleep
-        esp_deep_sleep_start();
+        goToSleep();
         return;
     }
 
     digitalWrite(MOSFET_PIN, HIGH);
-    delay(100);
+    delay(deviceConfig.powerOnDelayMs);
 
     // If the door is opened, close it
     if (!isDoorLocked) {
         isDoorLocked = true;
         servo.attach(SERVO_PIN);
-        servo.write(89);
-        delay(1000);
+        servo.write(deviceConfig.lockedAngle);
+        delay(deviceConfig.servoDwellMs);
 
         digitalWrite(MOSFET_PIN, LOW);
 
-        esp_deep_sleep_start();
+        // Let the server know the box is closed again
+        beginConnectToWiFi();
+        if (waitForWiFi(deviceConfig.wifiTimeoutMs)) {
+            reportDeviceEvent("relocked", "button");
+        }
+        WiFi.disconnect(true, false);
+
+        goToSleep();
         return;
     }
 
     servo.attach(SERVO_PIN);
-    servo.write(89);
+    servo.write(deviceConfig.lockedAngle);
 
     // Start connecting to WiFi
     beginConnectToWiFi();
@@ -60,6 +126,9 @@ void setup() {
     if (res.err != 0) {
         Serial.println("doRFIDLogic failed");
     }
+    if (res.readerVersion != 0x00) {
+        lastRFIDVersion = res.readerVersion;
+    }
 
     // Wait for WiFi to connect
     while (WiFi.status() != WL_CONNECTED) {
@@ -69,6 +138,17 @@ void setup() {
 
     Serial.println("Connected to WiFi.");
 
+    reportDeviceEvent("button_wake", "");
+    if (res.err == RFID_ERR_CARD) {
+        reportDeviceEvent("reader_error", "card");
+    }
+    else if (res.err == RFID_ERR_READER) {
+        reportDeviceEvent("reader_error", "reader");
+    }
+
+    // Pick up any configuration changes before moving the servo again
+    fetchDeviceConfig(&deviceConfig, deviceConfigETag, sizeof(deviceConfigETag));
+
     bool accessGranted = false;
     if (res.isNew) {
         requestCreateNewCard(res.uuid);
@@ -79,10 +159,24 @@ void setup() {
     }
 
     if (accessGranted) {
-        servo.write(1);
-        delay(1000);
+        servo.write(deviceConfig.unlockedAngle);
+        delay(deviceConfig.servoDwellMs);
         isDoorLocked = false;
+        reportDeviceEvent("unlocked", "card");
     }
+    else {
+        // Someone at the box may have asked for it to be opened remotely
+        char commandUUID[40];
+        if (checkInForUnlock(commandUUID, sizeof(commandUUID))) {
+            servo.write(deviceConfig.unlockedAngle);
+            delay(deviceConfig.servoDwellMs);
+            isDoorLocked = false;
+            reportDeviceEvent("unlocked", "remote");
+            acknowledgeUnlock(commandUUID, true);
+        }
+    }
+
+    sendHeartbeat("button", lastRFIDVersion);
 
     WiFi.disconnect(true, false);
 
@@ -90,7 +184,7 @@ void setup() {
     digitalWrite(MOSFET_PIN, LOW);
 
     // Go to sleep
-    esp_deep_sleep_start();
+    goToSleep();
 }
 
 void loop() {
@@ -1,9 +1,12 @@
 #include <HTTPClient.h>
+#include <ArduinoJson.h>
 
 #include "network.h"
 #include "esp_wpa2.h"
 #include "credentials.h"
 #include "rfid.h"
+#include "pins.h"
+#include "version.h"
 
 RTC_DATA_ATTR HTTPClient client;
 
@@ -111,3 +114,224 @@ bool requestLockboxAccess(byte uuid[]) {
 
     return responseCode == HTTP_CODE_NO_CONTENT;
 }
+
+// Report firmware, battery and radio health to the server
+void sendHeartbeat(const char *wakeReason, byte rfidVersion) {
+    Serial.println("begin heartbeat request");
+
+    // Spin up an HTTP client
+    while (!client.begin(HEARTBEAT_URL)) {
+        Serial.println("heartbeat client failed");
+    }
+
+    Serial.println("HTTP client begin");
+
+    // Set configured basic auth
+    client.addHeader("Authorization", BASIC_AUTH);
+    client.addHeader("Content-Type", "application/json");
+
+    // Battery voltage is only known if a sense divider is wired up
+    char batteryBuf[16] = "null";
+    #ifdef BATTERY_ADC_PIN
+    sprintf(batteryBuf, "%lu", analogReadMilliVolts(BATTERY_ADC_PIN) * BATTERY_DIVIDER_RATIO);
+    #endif
+
+    // A reader version of 0x00 means the reader was never queried this wake
+    char rfidVersionBuf[8] = "";
+    if (rfidVersion != 0x00) {
+        sprintf(rfidVersionBuf, "0x%02x", rfidVersion);
+    }
+
+    // Format JSON request body
+    char jsonBuf[384];
+    snprintf(jsonBuf, sizeof(jsonBuf),
+        "{\"device_id\":\"%s\",\"firmware_version\":\"%s\",\"uptime_ms\":%lu,"
+        "\"battery_mv\":%s,\"wifi_rssi\":%d,\"wake_reason\":\"%s\",\"rfid_version\":\"%s\"}",
+        WiFi.macAddress().c_str(),
+        FIRMWARE_VERSION,
+        millis(),
+        batteryBuf,
+        WiFi.RSSI(),
+        wakeReason,
+        rfidVersionBuf
+    );
+    Serial.printf("%s\n", jsonBuf);
+    String requestBody = String(jsonBuf);
+
+    // Do the request
+    int responseCode = client.POST(requestBody);
+
+    Serial.println("HTTP done post");
+
+    client.end();
+
+    Serial.println("HTTP end");
+
+    return;
+}
+
+// Refresh config from the server, skipping the download if the ETag matches
+bool fetchDeviceConfig(DeviceConfig *config, char *etag, size_t etagLen) {
+    Serial.println("begin fetch config request");
+
+    // Spin up an HTTP client
+    String url = String(CONFIG_URL) + "?device_id=" + WiFi.macAddress();
+    while (!client.begin(url)) {
+        Serial.println("config client failed");
+    }
+
+    Serial.println("HTTP client begin");
+
+    // Set configured basic auth
+    client.addHeader("Authorization", BASIC_AUTH);
+    if (etag[0] != '\0') {
+        client.addHeader("If-None-Match", etag);
+    }
+
+    const char *headerKeys[] = {"ETag"};
+    client.collectHeaders(headerKeys, 1);
+
+    // Do the request. 304 means our cached config is still current.
+    int responseCode = client.GET();
+    if (responseCode != HTTP_CODE_OK) {
+        Serial.printf("config not updated: %d\n", responseCode);
+        client.end();
+        return false;
+    }
+
+    JsonDocument doc;
+    DeserializationError err = deserializeJson(doc, client.getString());
+    if (err) {
+        Serial.println("unable to parse config");
+        client.end();
+        return false;
+    }
+
+    // Keep the current value for anything missing from the response
+    config->lockedAngle = doc["locked_angle"] | config->lockedAngle;
+    config->unlockedAngle = doc["unlocked_angle"] | config->unlockedAngle;
+    config->servoDwellMs = doc["servo_dwell_ms"] | config->servoDwellMs;
+    config->powerOnDelayMs = doc["power_on_delay_ms"] | config->powerOnDelayMs;
+    config->wifiTimeoutMs = doc["wifi_timeout_ms"] | config->wifiTimeoutMs;
+    config->heartbeatIntervalS = doc["heartbeat_interval_s"] | config->heartbeatIntervalS;
+
+    strncpy(etag, client.header("ETag").c_str(), etagLen - 1);
+    etag[etagLen - 1] = '\0';
+
+    client.end();
+
+    Serial.println("HTTP end");
+
+    return true;
+}
+
+// Ask the server whether someone requested a remote unlock from the dashboard
+bool checkInForUnlock(char *commandUUID, size_t commandUUIDLen) {
+    Serial.println("begin check in request");
+
+    // Spin up an HTTP client
+    while (!client.begin(CHECKIN_URL)) {
+        Serial.println("check in client failed");
+    }
+
+    Serial.println("HTTP client begin");
+
+    // Set configured basic auth
+    client.addHeader("Authorization", BASIC_AUTH);
+    client.addHeader("Content-Type", "application/json");
+
+    // Format JSON request body
+    char jsonBuf[128];
+    sprintf(jsonBuf, "{\"device_id\":\"%s\"}", WiFi.macAddress().c_str());
+    String requestBody = String(jsonBuf);
+
+    // Do the request. 204 means nothing is pending.
+    int responseCode = client.POST(requestBody);
+    if (responseCode != HTTP_CODE_OK) {
+        client.end();
+        return false;
+    }
+
+    JsonDocument doc;
+    DeserializationError err = deserializeJson(doc, client.getString());
+    client.end();
+    if (err || doc["command"] != "unlock") {
+        Serial.println("unable to parse check in response");
+        return false;
+    }
+
+    strncpy(commandUUID, doc["command_uuid"] | "", commandUUIDLen - 1);
+    commandUUID[commandUUIDLen - 1] = '\0';
+
+    Serial.println("HTTP end");
+
+    return commandUUID[0] != '\0';
+}
+
+void acknowledgeUnlock(const char *commandUUID, bool unlocked) {
+    Serial.println("begin acknowledge request");
+
+    // Spin up an HTTP client
+    String url = String(COMMANDS_URL) + commandUUID + "/ack";
+    while (!client.begin(url)) {
+        Serial.println("acknowledge client failed");
+    }
+
+    Serial.println("HTTP client begin");
+
+    // Set configured basic auth
+    client.addHeader("Authorization", BASIC_AUTH);
+    client.addHeader("Content-Type", "application/json");
+
+    // Format JSON request body
+    char jsonBuf[128];
+    sprintf(jsonBuf, "{\"device_id\":\"%s\",\"result\":\"%s\"}",
+        WiFi.macAddress().c_str(), unlocked ? "unlocked" : "failed");
+    String requestBody = String(jsonBuf);
+
+    // Do the request
+    int responseCode = client.POST(requestBody);
+
+    Serial.println("HTTP done post");
+
+    client.end();
+
+    Serial.println("HTTP end");
+
+    return;
+}
+
+// Tell the server what just happened to the door or reader
+void reportDeviceEvent(const char *type, const char *detail) {
+    Serial.println("begin device event request");
+
+    // Spin up an HTTP client
+    while (!client.begin(EVENTS_URL)) {
+        Serial.println("device event client failed");
+    }
+
+    Serial.println("HTTP client begin");
+
+    // Set configured basic auth
+    client.addHeader("Authorization", BASIC_AUTH);
+    client.addHeader("Content-Type", "application/json");
+
+    // Format JSON request body
+    char jsonBuf[192];
+    snprintf(jsonBuf, sizeof(jsonBuf),
+        "{\"device_id\":\"%s\",\"type\":\"%s\",\"detail\":\"%s\"}",
+        WiFi.macAddress().c_str(), type, detail);
+    Serial.printf("%s\n", jsonBuf);
+    String requestBody = String(jsonBuf);
+
+    // Do the request
+    int responseCode = client.POST(requestBody);
+
+    Serial.println("HTTP done post");
+
+    client.end();
+
+    Serial.println("HTTP end");
+
+    return;
+}
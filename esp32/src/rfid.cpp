@@ -35,18 +35,26 @@ RFIDResult doRFIDLogic() {
 
     mfrc522.PCD_Init();
     mfrc522.PCD_DumpVersionToSerial();
+    result.readerVersion = mfrc522.PCD_ReadRegister(MFRC522::VersionReg);
+
+    // A floating or shorted SPI bus reads back as all zeros or all ones
+    if (result.readerVersion == 0x00 || result.readerVersion == 0xFF) {
+        Serial.println("RFID reader not responding");
+        result.err = RFID_ERR_READER;
+        return result;
+    }
 
     // Check if there's a card present
     if (!mfrc522.PICC_IsNewCardPresent()) {
         Serial.println("No card present");
-        result.err = -1;
+        result.err = RFID_ERR_NO_CARD;
         return result;
     }
     
     // Attempt to read the card UID
     if (!mfrc522.PICC_ReadCardSerial()) {
         Serial.println("Unable to read card");
-        result.err = -1;
+        result.err = RFID_ERR_CARD;
         return result;
     }
 
@@ -71,7 +79,7 @@ RFIDResult doRFIDLogic() {
         status = mfrc522.MIFARE_Write(dataBlockAddr, result.uuid, 16);
         if (status != MFRC522::STATUS_OK) {
             Serial.println("Unable to write new random UUID to card");
-            result.err = -1;
+            result.err = RFID_ERR_CARD;
             return result;
         }
 
@@ -100,7 +108,7 @@ RFIDResult doRFIDLogic() {
         if (status != MFRC522::STATUS_OK) {
             Serial.println("Unable to write new security block to card:");
             Serial.println(MFRC522::GetStatusCodeName(status));
-            result.err = -1;
+            result.err = RFID_ERR_CARD;
             return result;
         }
 
@@ -117,14 +125,14 @@ RFIDResult doRFIDLogic() {
     // Check if there's a card present
     if (!mfrc522.PICC_IsNewCardPresent()) {
         Serial.println("No card present");
-        result.err = -1;
+        result.err = RFID_ERR_NO_CARD;
         return result;
     }
     
     // Attempt to read the card UID
     if (!mfrc522.PICC_ReadCardSerial()) {
         Serial.println("Unable to read card");
-        result.err = -1;
+        result.err = RFID_ERR_CARD;
         return result;
     }
 
@@ -138,7 +146,7 @@ RFIDResult doRFIDLogic() {
     if (status != MFRC522::STATUS_OK) {
         Serial.println("Unable to authenticate card with private key:");
         Serial.println(MFRC522::GetStatusCodeName(status));
-        result.err = -1;
+        result.err = RFID_ERR_CARD;
         return result;
     }
 
@@ -148,7 +156,7 @@ RFIDResult doRFIDLogic() {
     if (status != MFRC522::STATUS_OK) {
         Serial.println("Unable to read data block with private key:");
         Serial.println(MFRC522::GetStatusCodeName(status));
-        result.err = -1;
+        result.err = RFID_ERR_CARD;
         return result;
     }
 
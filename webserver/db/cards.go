@@ -127,12 +127,15 @@ func (p *Pool) SetCardOpens(ctx context.Context, cardUUID uuid.UUID, numOpens in
 	return
 }
 
-// AddCardOpens adds a number of allowed opens for a card.
+// AddCardOpens adds a number of allowed opens for a card. The count is
+// left alone if it would go negative, as that means infinite opens and
+// has to be set deliberately with SetCardOpens.
 func (p *Pool) AddCardOpens(ctx context.Context, cardUUID uuid.UUID, numOpens int) (err error) {
 	if _, err = p.Exec(ctx, `
 		UPDATE cards
 		SET remaining_opens = remaining_opens + $1
-		WHERE uuid = $2`, numOpens, cardUUID,
+		WHERE uuid = $2
+		AND remaining_opens + $1 >= 0;`, numOpens, cardUUID,
 	); err != nil {
 		return
 	}
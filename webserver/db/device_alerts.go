@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+type DeviceAlertKind string
+
+const (
+	DeviceAlertDoorOpen     DeviceAlertKind = "door_open"
+	DeviceAlertOffline      DeviceAlertKind = "offline"
+	DeviceAlertReaderErrors DeviceAlertKind = "reader_errors"
+)
+
+type DeviceAlertState string
+
+const (
+	DeviceAlertStateOpen         DeviceAlertState = "open"
+	DeviceAlertStateAcknowledged DeviceAlertState = "acknowledged"
+	DeviceAlertStateResolved     DeviceAlertState = "resolved"
+)
+
+type DeviceAlert struct {
+	UUID           uuid.UUID
+	DeviceID       string
+	DeviceName     string
+	DeviceOwner    *uuid.UUID
+	Kind           DeviceAlertKind
+	Message        string
+	CreatedAt      time.Time
+	State          DeviceAlertState
+	AcknowledgedAt *time.Time
+	AcknowledgedBy *uuid.UUID
+	ResolvedAt     *time.Time
+	ResolvedBy     *uuid.UUID
+}
+
+// IsDeviceOwnedBy reports whether the alert's device belongs to the user.
+// Only set on alerts from ListDeviceAlerts.
+func (a *DeviceAlert) IsDeviceOwnedBy(userUUID uuid.UUID) bool {
+	return a.DeviceOwner != nil && *a.DeviceOwner == userUUID
+}
+
+// OpenDeviceAlert raises an alert unless one of the same kind is already
+// unresolved for the device. alert is nil if nothing new was raised.
+func (p *Pool) OpenDeviceAlert(ctx context.Context, deviceID string, kind DeviceAlertKind, message string) (alert *DeviceAlert, err error) {
+	alertUUID, err := uuid.NewRandom()
+	if err != nil {
+		return
+	}
+
+	alert = &DeviceAlert{
+		UUID:      alertUUID,
+		DeviceID:  deviceID,
+		Kind:      kind,
+		Message:   message,
+		CreatedAt: time.Now().UTC(),
+		State:     DeviceAlertStateOpen,
+	}
+
+	row := p.QueryRow(ctx, `
+		INSERT INTO device_alerts
+		(uuid, device_id, kind, message, created_at, state)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (device_id, kind) WHERE state <> 'resolved'
+		DO NOTHING
+		RETURNING uuid;`,
+		alert.UUID, alert.DeviceID, alert.Kind,
+		alert.Message, alert.CreatedAt, alert.State,
+	)
+
+	if err = row.Scan(&alert.UUID); err != nil {
+		alert = nil
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+
+	return
+}
+
+// ListDeviceAlerts lists alerts newest first. If deviceID is empty, alerts
+// for every device are listed. If activeOnly is set, resolved alerts are
+// left out.
+func (p *Pool) ListDeviceAlerts(ctx context.Context, deviceID string, activeOnly bool, limit int) (alerts []*DeviceAlert, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT
+		a.uuid, a.device_id, d.friendly_name, d.owner_uuid, a.kind, a.message,
+		a.created_at, a.state, a.acknowledged_at, a.acknowledged_by,
+		a.resolved_at, a.resolved_by
+		FROM device_alerts a
+		JOIN devices d ON d.id = a.device_id
+		WHERE ($1 = '' OR a.device_id = $1)
+		AND (NOT $2 OR a.state <> 'resolved')
+		ORDER BY a.created_at DESC
+		LIMIT $3;`, deviceID, activeOnly, limit,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	alerts = make([]*DeviceAlert, 0, 16)
+	for rows.Next() {
+		alert := &DeviceAlert{}
+		if err = rows.Scan(
+			&alert.UUID,
+			&alert.DeviceID,
+			&alert.DeviceName,
+			&alert.DeviceOwner,
+			&alert.Kind,
+			&alert.Message,
+			&alert.CreatedAt,
+			&alert.State,
+			&alert.AcknowledgedAt,
+			&alert.AcknowledgedBy,
+			&alert.ResolvedAt,
+			&alert.ResolvedBy,
+		); err != nil {
+			return
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// AcknowledgeDeviceAlert marks an open alert as seen by a user. Unless
+// anyDevice is set, only alerts on devices the user owns are updated.
+// ok is false when no such open alert exists.
+func (p *Pool) AcknowledgeDeviceAlert(ctx context.Context, alertUUID uuid.UUID, userUUID uuid.UUID, anyDevice bool) (ok bool, err error) {
+	tag, err := p.Exec(ctx, `
+		UPDATE device_alerts a
+		SET state = $1, acknowledged_at = $2, acknowledged_by = $3
+		FROM devices d
+		WHERE a.device_id = d.id
+		AND a.uuid = $4
+		AND a.state = $5
+		AND ($6 OR d.owner_uuid = $3);`,
+		DeviceAlertStateAcknowledged, time.Now().UTC(), userUUID,
+		alertUUID, DeviceAlertStateOpen, anyDevice,
+	)
+	if err != nil {
+		return
+	}
+
+	ok = tag.RowsAffected() == 1
+
+	return
+}
+
+// ResolveDeviceAlert closes an alert. If the condition persists, the
+// monitor will raise a fresh one. Unless anyDevice is set, only alerts on
+// devices the user owns are updated. ok is false when no such unresolved
+// alert exists.
+func (p *Pool) ResolveDeviceAlert(ctx context.Context, alertUUID uuid.UUID, userUUID uuid.UUID, anyDevice bool) (ok bool, err error) {
+	tag, err := p.Exec(ctx, `
+		UPDATE device_alerts a
+		SET state = $1, resolved_at = $2, resolved_by = $3
+		FROM devices d
+		WHERE a.device_id = d.id
+		AND a.uuid = $4
+		AND a.state <> $1
+		AND ($5 OR d.owner_uuid = $3);`,
+		DeviceAlertStateResolved, time.Now().UTC(), userUUID, alertUUID, anyDevice,
+	)
+	if err != nil {
+		return
+	}
+
+	ok = tag.RowsAffected() == 1
+
+	return
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+type DeviceEventType string
+
+const (
+	DeviceEventUnlocked    DeviceEventType = "unlocked"
+	DeviceEventRelocked    DeviceEventType = "relocked"
+	DeviceEventButtonWake  DeviceEventType = "button_wake"
+	DeviceEventReaderError DeviceEventType = "reader_error"
+)
+
+type DeviceEvent struct {
+	ID         int64
+	DeviceID   string
+	ReceivedAt time.Time
+	Type       DeviceEventType
+	Detail     string
+}
+
+// RecordDeviceEvent stores an event reported by a device and moves the
+// device's lock state along if the event opened or closed the door.
+func (p *Pool) RecordDeviceEvent(ctx context.Context, event *DeviceEvent) (err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err = markDeviceSeen(ctx, tx, event.DeviceID, event.ReceivedAt); err != nil {
+		return
+	}
+
+	row := tx.QueryRow(ctx, `
+		INSERT INTO device_events
+		(device_id, received_at, type, detail)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id;`,
+		event.DeviceID, event.ReceivedAt, event.Type, event.Detail,
+	)
+	if err = row.Scan(&event.ID); err != nil {
+		return
+	}
+
+	var newState DeviceLockState
+	switch event.Type {
+	case DeviceEventUnlocked:
+		newState = DeviceLockStateUnlocked
+	case DeviceEventRelocked:
+		newState = DeviceLockStateLocked
+	}
+
+	// Repeating the current state keeps the original "since" time
+	if newState != "" {
+		if _, err = tx.Exec(ctx, `
+			UPDATE devices
+			SET lock_state = $1, lock_state_since = $2
+			WHERE id = $3
+			AND lock_state <> $1;`,
+			newState, event.ReceivedAt, event.DeviceID,
+		); err != nil {
+			return
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+// ListDeviceEvents lists the most recent events for a device, newest first.
+func (p *Pool) ListDeviceEvents(ctx context.Context, deviceID string, limit int) (events []*DeviceEvent, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT id, received_at, type, detail
+		FROM device_events
+		WHERE device_id = $1
+		ORDER BY received_at DESC
+		LIMIT $2;`, deviceID, limit,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	events = make([]*DeviceEvent, 0, limit)
+	for rows.Next() {
+		event := &DeviceEvent{DeviceID: deviceID}
+		if err = rows.Scan(
+			&event.ID,
+			&event.ReceivedAt,
+			&event.Type,
+			&event.Detail,
+		); err != nil {
+			return
+		}
+
+		events = append(events, event)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// CountDeviceEvents counts events of a type reported by a device since a given time.
+func (p *Pool) CountDeviceEvents(ctx context.Context, deviceID string, eventType DeviceEventType, since time.Time) (count int, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT COUNT(id) FROM device_events
+		WHERE device_id = $1
+		AND type = $2
+		AND received_at >= $3;`, deviceID, eventType, since)
+	err = row.Scan(&count)
+	return
+}
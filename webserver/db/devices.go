@@ -0,0 +1,335 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+type Device struct {
+	ID           string
+	CreatedAt    time.Time
+	FriendlyName string
+	LastSeenAt   time.Time
+
+	// LockState is what the device last reported about its door. It is
+	// DeviceLockStateUnknown until the first unlocked or relocked event.
+	LockState      DeviceLockState
+	LockStateSince *time.Time
+
+	// OwnerUUID is the user notified about this device's alerts, if any.
+	OwnerUUID  *uuid.UUID
+	OwnerEmail string
+
+	AlertSettings DeviceAlertSettings
+
+	// PinnedFirmwareUUID is the release this device is held to, if any.
+	PinnedFirmwareUUID *uuid.UUID
+
+	// LatestHeartbeat is nil if the device has never reported in.
+	LatestHeartbeat *DeviceHeartbeat
+}
+
+// IsOffline reports whether the device has been silent for longer than after.
+func (d *Device) IsOffline(after time.Duration) bool {
+	return time.Since(d.LastSeenAt) > after
+}
+
+// IsOwnedBy reports whether the user is the device's owner.
+func (d *Device) IsOwnedBy(userUUID uuid.UUID) bool {
+	return d.OwnerUUID != nil && *d.OwnerUUID == userUUID
+}
+
+// LockStateDuration is how long the device has been in its current lock state.
+func (d *Device) LockStateDuration() time.Duration {
+	if d.LockStateSince == nil {
+		return 0
+	}
+
+	return time.Since(*d.LockStateSince).Round(time.Second)
+}
+
+// DeviceAlertSettings are the per-device alert thresholds. A threshold
+// of 0 disables that alert.
+type DeviceAlertSettings struct {
+	UnlockedMinutes int
+	OfflineHours    int
+
+	// ReaderErrors is the number of reader errors within an hour.
+	ReaderErrors int
+}
+
+type DeviceLockState string
+
+const (
+	DeviceLockStateUnknown  DeviceLockState = "unknown"
+	DeviceLockStateLocked   DeviceLockState = "locked"
+	DeviceLockStateUnlocked DeviceLockState = "unlocked"
+)
+
+type DeviceHeartbeat struct {
+	DeviceID        string
+	ReceivedAt      time.Time
+	FirmwareVersion string
+	UptimeMs        int64
+	BatteryMv       *int // nil if the device cannot measure its battery
+	WiFiRSSI        int
+	WakeReason      string
+	RFIDVersion     string
+}
+
+// RecordDeviceHeartbeat stores a heartbeat, registering the device
+// on first contact and bumping its last seen time otherwise.
+func (p *Pool) RecordDeviceHeartbeat(ctx context.Context, hb *DeviceHeartbeat) (err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err = markDeviceSeen(ctx, tx, hb.DeviceID, hb.ReceivedAt); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO device_heartbeats
+		(device_id, received_at, firmware_version, uptime_ms,
+		 battery_mv, wifi_rssi, wake_reason, rfid_version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`,
+		hb.DeviceID, hb.ReceivedAt,
+		hb.FirmwareVersion, hb.UptimeMs,
+		hb.BatteryMv, hb.WiFiRSSI,
+		hb.WakeReason, hb.RFIDVersion,
+	); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+// markDeviceSeen registers a device on first contact and bumps
+// its last seen time otherwise.
+func markDeviceSeen(ctx context.Context, tx pgx.Tx, deviceID string, seenAt time.Time) (err error) {
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO devices
+		(id, created_at, friendly_name, last_seen_at)
+		VALUES ($1, $2, $3, $2)
+		ON CONFLICT (id) DO UPDATE
+		SET last_seen_at = GREATEST(devices.last_seen_at, excluded.last_seen_at);`,
+		deviceID, seenAt, "New Device",
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// ListDevices lists every known device along with its most recent heartbeat.
+func (p *Pool) ListDevices(ctx context.Context) (devices []*Device, err error) {
+	rows, err := p.Query(ctx, selectDeviceWithHeartbeat+`
+		ORDER BY d.created_at DESC;`,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	devices = make([]*Device, 0, 16)
+	for rows.Next() {
+		var device *Device
+		if device, err = scanDeviceWithHeartbeat(rows); err != nil {
+			return
+		}
+
+		devices = append(devices, device)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (p *Pool) SelectDevice(ctx context.Context, deviceID string) (device *Device, err error) {
+	row := p.QueryRow(ctx, selectDeviceWithHeartbeat+`
+		WHERE d.id = $1;`, deviceID)
+
+	return scanDeviceWithHeartbeat(row)
+}
+
+// selectDeviceWithHeartbeat selects devices joined with their latest
+// heartbeat. Rows must be scanned with scanDeviceWithHeartbeat.
+const selectDeviceWithHeartbeat = `
+		SELECT
+		d.id, d.created_at, d.friendly_name, d.last_seen_at,
+		d.lock_state, d.lock_state_since,
+		d.owner_uuid, COALESCE(o.email, ''),
+		d.alert_unlocked_minutes, d.alert_offline_hours, d.alert_reader_errors,
+		d.pinned_firmware_uuid,
+		h.received_at, h.firmware_version, h.uptime_ms,
+		h.battery_mv, h.wifi_rssi, h.wake_reason, h.rfid_version
+		FROM devices d
+		LEFT JOIN users o ON o.uuid = d.owner_uuid
+		LEFT JOIN LATERAL (
+			SELECT * FROM device_heartbeats
+			WHERE device_id = d.id
+			ORDER BY received_at DESC
+			LIMIT 1
+		) h ON true
+`
+
+func scanDeviceWithHeartbeat(row pgx.Row) (device *Device, err error) {
+	device = &Device{}
+
+	// Every heartbeat column is nullable because of the outer join
+	var (
+		receivedAt      *time.Time
+		firmwareVersion *string
+		uptimeMs        *int64
+		batteryMv       *int
+		wifiRSSI        *int
+		wakeReason      *string
+		rfidVersion     *string
+	)
+
+	if err = row.Scan(
+		&device.ID,
+		&device.CreatedAt,
+		&device.FriendlyName,
+		&device.LastSeenAt,
+		&device.LockState,
+		&device.LockStateSince,
+		&device.OwnerUUID,
+		&device.OwnerEmail,
+		&device.AlertSettings.UnlockedMinutes,
+		&device.AlertSettings.OfflineHours,
+		&device.AlertSettings.ReaderErrors,
+		&device.PinnedFirmwareUUID,
+		&receivedAt,
+		&firmwareVersion,
+		&uptimeMs,
+		&batteryMv,
+		&wifiRSSI,
+		&wakeReason,
+		&rfidVersion,
+	); err != nil {
+		return
+	}
+
+	if receivedAt != nil {
+		device.LatestHeartbeat = &DeviceHeartbeat{
+			DeviceID:        device.ID,
+			ReceivedAt:      *receivedAt,
+			FirmwareVersion: *firmwareVersion,
+			UptimeMs:        *uptimeMs,
+			BatteryMv:       batteryMv,
+			WiFiRSSI:        *wifiRSSI,
+			WakeReason:      *wakeReason,
+			RFIDVersion:     *rfidVersion,
+		}
+	}
+
+	return
+}
+
+// ListDeviceHeartbeats lists the most recent heartbeats for a device, newest first.
+func (p *Pool) ListDeviceHeartbeats(ctx context.Context, deviceID string, limit int) (heartbeats []*DeviceHeartbeat, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT
+		received_at, firmware_version, uptime_ms,
+		battery_mv, wifi_rssi, wake_reason, rfid_version
+		FROM device_heartbeats
+		WHERE device_id = $1
+		ORDER BY received_at DESC
+		LIMIT $2;`, deviceID, limit,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	heartbeats = make([]*DeviceHeartbeat, 0, limit)
+	for rows.Next() {
+		hb := &DeviceHeartbeat{DeviceID: deviceID}
+		if err = rows.Scan(
+			&hb.ReceivedAt,
+			&hb.FirmwareVersion,
+			&hb.UptimeMs,
+			&hb.BatteryMv,
+			&hb.WiFiRSSI,
+			&hb.WakeReason,
+			&hb.RFIDVersion,
+		); err != nil {
+			return
+		}
+
+		heartbeats = append(heartbeats, hb)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// SelectDeviceConfig loads the raw JSON configuration stored for a device.
+// err is pgx.ErrNoRows if the device has never been configured.
+func (p *Pool) SelectDeviceConfig(ctx context.Context, deviceID string) (config []byte, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT config FROM device_configs WHERE device_id = $1;`, deviceID)
+	err = row.Scan(&config)
+	return
+}
+
+func (p *Pool) UpsertDeviceConfig(ctx context.Context, deviceID string, config []byte) (err error) {
+	if _, err = p.Exec(ctx, `
+		INSERT INTO device_configs
+		(device_id, config, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (device_id) DO UPDATE
+		SET config = excluded.config, updated_at = excluded.updated_at;`,
+		deviceID, config, time.Now().UTC(),
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// SetDeviceOwner sets the user who is notified about a device's alerts.
+// Unless replaceOwner is set, a device that already has another owner is
+// left alone and false is reported.
+func (p *Pool) SetDeviceOwner(ctx context.Context, deviceID string, ownerUUID uuid.UUID, replaceOwner bool) (ok bool, err error) {
+	tag, err := p.Exec(ctx, `
+		UPDATE devices
+		SET owner_uuid = $1
+		WHERE id = $2
+		AND ($3 OR owner_uuid IS NULL OR owner_uuid = $1);`, ownerUUID, deviceID, replaceOwner,
+	)
+	if err != nil {
+		return
+	}
+
+	ok = tag.RowsAffected() == 1
+
+	return
+}
+
+func (p *Pool) SetDeviceAlertSettings(ctx context.Context, deviceID string, settings *DeviceAlertSettings) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE devices
+		SET alert_unlocked_minutes = $1,
+		    alert_offline_hours = $2,
+		    alert_reader_errors = $3
+		WHERE id = $4;`,
+		settings.UnlockedMinutes, settings.OfflineHours,
+		settings.ReaderErrors, deviceID,
+	); err != nil {
+		return
+	}
+
+	return
+}
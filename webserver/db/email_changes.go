@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// InsertEmailChange stores a request to move a user to newEmail, waiting
+// for the new address to be confirmed. Only a hash of the token is stored.
+func (p *Pool) InsertEmailChange(ctx context.Context, tokenHash []byte, userUUID uuid.UUID, newEmail string, expiresAt time.Time) (err error) {
+	if _, err = p.Exec(ctx, `
+		INSERT INTO email_changes
+		(token_hash, user_uuid, new_email, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5);`,
+		tokenHash, userUUID, newEmail, time.Now().UTC(), expiresAt,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// EmailChangeExists checks whether tokenHash belongs to an unexpired email
+// change without using it up.
+func (p *Pool) EmailChangeExists(ctx context.Context, tokenHash []byte) (exists bool, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM email_changes
+			WHERE token_hash = $1
+			AND expires_at > $2
+		);`,
+		tokenHash, time.Now().UTC(),
+	)
+
+	err = row.Scan(&exists)
+
+	return
+}
+
+// ConfirmEmailChange moves the user to the address of the unexpired email
+// change matching tokenHash, using up all of that user's email changes.
+// pgx.ErrNoRows is returned if there is no such change, and
+// EmailAlreadyRegisteredError if the address was taken in the meantime.
+func (p *Pool) ConfirmEmailChange(ctx context.Context, tokenHash []byte) (user *User, err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var userUUID uuid.UUID
+	var newEmail string
+	row := tx.QueryRow(ctx, `
+		DELETE FROM email_changes
+		WHERE token_hash = $1
+		AND expires_at > $2
+		RETURNING user_uuid, new_email;`,
+		tokenHash, time.Now().UTC(),
+	)
+	if err = row.Scan(&userUUID, &newEmail); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM email_changes WHERE user_uuid = $1;`,
+		userUUID,
+	); err != nil {
+		return
+	}
+
+	var exists bool
+	if err = tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE email = $1);`,
+		newEmail,
+	).Scan(&exists); err != nil {
+		return
+	}
+
+	if exists {
+		err = EmailAlreadyRegisteredError
+		return
+	}
+
+	if user, err = scanUser(tx.QueryRow(ctx, `
+		UPDATE users
+		SET email = $1
+		WHERE uuid = $2
+		RETURNING `+userColumns+`;`,
+		newEmail, userUUID,
+	)); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+// DeleteExpiredEmailChanges removes email changes that were never
+// confirmed.
+func (p *Pool) DeleteExpiredEmailChanges(ctx context.Context) (count int64, err error) {
+	tag, err := p.Exec(ctx, `
+		DELETE FROM email_changes WHERE expires_at <= $1;`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return
+	}
+
+	count = tag.RowsAffected()
+
+	return
+}
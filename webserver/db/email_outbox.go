@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+type OutboxEmailStatus string
+
+const (
+	OutboxEmailPending OutboxEmailStatus = "pending"
+	OutboxEmailSent    OutboxEmailStatus = "sent"
+
+	// OutboxEmailDead marks a message that ran out of delivery attempts.
+	// It stays put until an admin requeues it.
+	OutboxEmailDead OutboxEmailStatus = "dead"
+)
+
+type OutboxEmail struct {
+	UUID          uuid.UUID
+	CreatedAt     time.Time
+	To            []string
+	Subject       string
+	HTMLBody      string
+	TextBody      string
+	Status        OutboxEmailStatus
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	SentAt        *time.Time
+}
+
+// EnqueueEmail adds a message to the outbox for the delivery worker to send.
+func (p *Pool) EnqueueEmail(ctx context.Context, to []string, subject string, htmlBody string, textBody string) (email *OutboxEmail, err error) {
+	emailUUID, err := uuid.NewRandom()
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	email = &OutboxEmail{
+		UUID:          emailUUID,
+		CreatedAt:     now,
+		To:            to,
+		Subject:       subject,
+		HTMLBody:      htmlBody,
+		TextBody:      textBody,
+		Status:        OutboxEmailPending,
+		NextAttemptAt: now,
+	}
+
+	if _, err = p.Exec(ctx, `
+		INSERT INTO email_outbox
+		(uuid, created_at, to_addrs, subject, html_body, text_body,
+		 status, attempts, next_attempt_at, last_error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`,
+		email.UUID, email.CreatedAt, email.To,
+		email.Subject, email.HTMLBody, email.TextBody,
+		email.Status, email.Attempts, email.NextAttemptAt, email.LastError,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// ClaimDueEmails picks up to limit pending messages that are due and pushes
+// their next attempt out by lease, so no other worker picks them up while
+// they are being delivered.
+func (p *Pool) ClaimDueEmails(ctx context.Context, limit int, lease time.Duration) (emails []*OutboxEmail, err error) {
+	now := time.Now().UTC()
+
+	rows, err := p.Query(ctx, `
+		UPDATE email_outbox
+		SET next_attempt_at = $1
+		WHERE uuid IN (
+			SELECT uuid FROM email_outbox
+			WHERE status = $2
+			AND next_attempt_at <= $3
+			ORDER BY next_attempt_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING
+		uuid, created_at, to_addrs, subject, html_body, text_body,
+		status, attempts, next_attempt_at, last_error, sent_at;`,
+		now.Add(lease), OutboxEmailPending, now, limit,
+	)
+	if err != nil {
+		return
+	}
+
+	return collectOutboxEmails(rows)
+}
+
+// MarkEmailSent records a successful delivery. The bodies are cleared, as
+// they can hold single-use links that shouldn't outlive the email.
+func (p *Pool) MarkEmailSent(ctx context.Context, emailUUID uuid.UUID) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE email_outbox
+		SET status = $1, attempts = attempts + 1, sent_at = $2, last_error = '',
+		html_body = '', text_body = ''
+		WHERE uuid = $3;`,
+		OutboxEmailSent, time.Now().UTC(), emailUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// MarkEmailFailed records a failed delivery. The message is retried at
+// nextAttemptAt, or dead-lettered if dead is set.
+func (p *Pool) MarkEmailFailed(ctx context.Context, emailUUID uuid.UUID, lastError string, nextAttemptAt time.Time, dead bool) (err error) {
+	status := OutboxEmailPending
+	if dead {
+		status = OutboxEmailDead
+	}
+
+	if _, err = p.Exec(ctx, `
+		UPDATE email_outbox
+		SET status = $1, attempts = attempts + 1,
+		    next_attempt_at = $2, last_error = $3
+		WHERE uuid = $4;`,
+		status, nextAttemptAt, lastError, emailUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// RequeueEmail gives a dead-lettered message a fresh set of attempts.
+func (p *Pool) RequeueEmail(ctx context.Context, emailUUID uuid.UUID) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE email_outbox
+		SET status = $1, attempts = 0, next_attempt_at = $2
+		WHERE uuid = $3
+		AND status = $4;`,
+		OutboxEmailPending, time.Now().UTC(), emailUUID, OutboxEmailDead,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// ListUndeliveredEmails lists dead-lettered messages and pending messages
+// that have failed at least once, newest first. The bodies are left out, as
+// they can hold links that would let whoever sees them act as the recipient.
+func (p *Pool) ListUndeliveredEmails(ctx context.Context, limit int) (emails []*OutboxEmail, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT
+		uuid, created_at, to_addrs, subject, '', '',
+		status, attempts, next_attempt_at, last_error, sent_at
+		FROM email_outbox
+		WHERE status = $1
+		OR (status = $2 AND attempts > 0)
+		ORDER BY created_at DESC
+		LIMIT $3;`,
+		OutboxEmailDead, OutboxEmailPending, limit,
+	)
+	if err != nil {
+		return
+	}
+
+	return collectOutboxEmails(rows)
+}
+
+// DeleteOldOutboxEmails deletes sent and dead-lettered messages queued
+// more than olderThan ago.
+func (p *Pool) DeleteOldOutboxEmails(ctx context.Context, olderThan time.Duration) (count int64, err error) {
+	tag, err := p.Exec(ctx, `
+		DELETE FROM email_outbox
+		WHERE status IN ($1, $2)
+		AND created_at <= $3;`,
+		OutboxEmailSent, OutboxEmailDead, time.Now().UTC().Add(-olderThan),
+	)
+	if err != nil {
+		return
+	}
+
+	count = tag.RowsAffected()
+
+	return
+}
+
+func collectOutboxEmails(rows pgx.Rows) (emails []*OutboxEmail, err error) {
+	defer rows.Close()
+
+	emails = make([]*OutboxEmail, 0, 16)
+	for rows.Next() {
+		email := &OutboxEmail{}
+		if err = rows.Scan(
+			&email.UUID,
+			&email.CreatedAt,
+			&email.To,
+			&email.Subject,
+			&email.HTMLBody,
+			&email.TextBody,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+			&email.SentAt,
+		); err != nil {
+			return
+		}
+
+		emails = append(emails, email)
+	}
+
+	err = rows.Err()
+
+	return
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"time"
+)
+
+type FirmwareRelease struct {
+	UUID           uuid.UUID
+	CreatedAt      time.Time
+	Version        string
+	Hardware       string
+	Size           int64
+	SHA256         []byte
+	Signature      []byte
+	RolloutPercent int
+}
+
+func (r *FirmwareRelease) SHA256Hex() string {
+	return hex.EncodeToString(r.SHA256)
+}
+
+func (p *Pool) InsertFirmwareRelease(ctx context.Context, release *FirmwareRelease, image []byte) (err error) {
+	if _, err = p.Exec(ctx, `
+		INSERT INTO firmware_releases
+		(uuid, created_at, version, hardware, size,
+		 sha256, signature, rollout_percent, image)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+		release.UUID, release.CreatedAt,
+		release.Version, release.Hardware, release.Size,
+		release.SHA256, release.Signature,
+		release.RolloutPercent, image,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// ListFirmwareReleases lists releases newest first. If hardware is empty,
+// releases for every hardware revision are listed.
+func (p *Pool) ListFirmwareReleases(ctx context.Context, hardware string) (releases []*FirmwareRelease, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT
+		uuid, created_at, version, hardware, size,
+		sha256, signature, rollout_percent
+		FROM firmware_releases
+		WHERE $1 = '' OR hardware = $1
+		ORDER BY created_at DESC;`, hardware,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	releases = make([]*FirmwareRelease, 0, 16)
+	for rows.Next() {
+		release := &FirmwareRelease{}
+		if err = rows.Scan(
+			&release.UUID,
+			&release.CreatedAt,
+			&release.Version,
+			&release.Hardware,
+			&release.Size,
+			&release.SHA256,
+			&release.Signature,
+			&release.RolloutPercent,
+		); err != nil {
+			return
+		}
+
+		releases = append(releases, release)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (p *Pool) SelectFirmwareRelease(ctx context.Context, releaseUUID uuid.UUID) (release *FirmwareRelease, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT
+		uuid, created_at, version, hardware, size,
+		sha256, signature, rollout_percent
+		FROM firmware_releases
+		WHERE uuid = $1;`, releaseUUID)
+
+	release = &FirmwareRelease{}
+	if err = row.Scan(
+		&release.UUID,
+		&release.CreatedAt,
+		&release.Version,
+		&release.Hardware,
+		&release.Size,
+		&release.SHA256,
+		&release.Signature,
+		&release.RolloutPercent,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *Pool) SelectFirmwareImage(ctx context.Context, releaseUUID uuid.UUID) (image []byte, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT image FROM firmware_releases WHERE uuid = $1;`, releaseUUID)
+	err = row.Scan(&image)
+	return
+}
+
+// SetFirmwareRolloutPercent sets the percentage of devices, from 0 to 100,
+// that are offered a release.
+func (p *Pool) SetFirmwareRolloutPercent(ctx context.Context, releaseUUID uuid.UUID, percent int) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE firmware_releases
+		SET rollout_percent = $1
+		WHERE uuid = $2;`, percent, releaseUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// SetDevicePinnedFirmware pins a device to a release regardless of
+// rollout. Pass nil to unpin it.
+func (p *Pool) SetDevicePinnedFirmware(ctx context.Context, deviceID string, releaseUUID *uuid.UUID) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE devices
+		SET pinned_firmware_uuid = $1
+		WHERE id = $2;`, releaseUUID, deviceID,
+	); err != nil {
+		return
+	}
+
+	return
+}
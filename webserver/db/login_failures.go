@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"time"
+)
+
+// RecordFailedLogin counts a wrong password against a user. On the
+// lockAfter'th failure in a row the account is locked for lockFor, and the
+// count starts again. locked reports whether this failure caused a lock.
+func (p *Pool) RecordFailedLogin(ctx context.Context, userUUID uuid.UUID, lockAfter int, lockFor time.Duration) (locked bool, err error) {
+	now := time.Now().UTC()
+
+	var failedLoginCount int
+	if err = p.QueryRow(ctx, `
+		UPDATE users
+		SET failed_login_count = CASE
+		        WHEN failed_login_count + 1 >= $1 THEN 0
+		        ELSE failed_login_count + 1
+		    END,
+		    locked_until = CASE
+		        WHEN failed_login_count + 1 >= $1 THEN $2::TIMESTAMPTZ
+		        ELSE locked_until
+		    END,
+		    last_failed_login_at = $3
+		WHERE uuid = $4
+		RETURNING failed_login_count;`,
+		lockAfter, now.Add(lockFor), now, userUUID,
+	).Scan(&failedLoginCount); err != nil {
+		return
+	}
+
+	locked = failedLoginCount == 0
+
+	return
+}
+
+// ClearFailedLogins forgets a user's failed logins and unlocks them.
+func (p *Pool) ClearFailedLogins(ctx context.Context, userUUID uuid.UUID) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE users
+		SET failed_login_count = 0,
+		    last_failed_login_at = NULL,
+		    locked_until = NULL
+		WHERE uuid = $1;`,
+		userUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// Passkey is a WebAuthn credential a user can log in with. Credential is
+// the JSON encoded credential record, which is updated after every login
+// with the authenticator's new signature counter.
+type Passkey struct {
+	ID         []byte
+	UserUUID   uuid.UUID
+	Name       string
+	Credential []byte
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+func (p *Pool) InsertPasskey(ctx context.Context, passkey *Passkey) (err error) {
+	if _, err = p.Exec(ctx, `
+		INSERT INTO passkeys
+		(id, user_uuid, name, credential, created_at)
+		VALUES ($1, $2, $3, $4, $5);`,
+		passkey.ID, passkey.UserUUID, passkey.Name,
+		passkey.Credential, passkey.CreatedAt,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+func scanPasskey(row pgx.Row) (passkey *Passkey, err error) {
+	passkey = &Passkey{}
+	if err = row.Scan(
+		&passkey.ID,
+		&passkey.UserUUID,
+		&passkey.Name,
+		&passkey.Credential,
+		&passkey.CreatedAt,
+		&passkey.LastUsedAt,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// ListUserPasskeys lists a user's passkeys, oldest first.
+func (p *Pool) ListUserPasskeys(ctx context.Context, userUUID uuid.UUID) (passkeys []*Passkey, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT
+		id, user_uuid, name, credential, created_at, last_used_at
+		FROM passkeys
+		WHERE user_uuid = $1
+		ORDER BY created_at;`,
+		userUUID,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	passkeys = make([]*Passkey, 0, 4)
+	for rows.Next() {
+		var passkey *Passkey
+		if passkey, err = scanPasskey(rows); err != nil {
+			return
+		}
+
+		passkeys = append(passkeys, passkey)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// UpdatePasskeyCredential stores the credential record as it was after a
+// successful login.
+func (p *Pool) UpdatePasskeyCredential(ctx context.Context, id []byte, credential []byte) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE passkeys
+		SET credential = $1, last_used_at = $2
+		WHERE id = $3;`,
+		credential, time.Now().UTC(), id,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// DeletePasskey removes one of a user's passkeys.
+func (p *Pool) DeletePasskey(ctx context.Context, id []byte, userUUID uuid.UUID) (err error) {
+	if _, err = p.Exec(ctx, `
+		DELETE FROM passkeys
+		WHERE id = $1
+		AND user_uuid = $2;`,
+		id, userUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// UsePasskeyCeremony records that the ceremony with the given token ID
+// was finished. It reports false if it already was, so a ceremony can't
+// be replayed while its token is still valid.
+func (p *Pool) UsePasskeyCeremony(ctx context.Context, id uuid.UUID, expiresAt time.Time) (ok bool, err error) {
+	tag, err := p.Exec(ctx, `
+		INSERT INTO used_passkey_ceremonies
+		(id, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING;`,
+		id, expiresAt,
+	)
+	if err != nil {
+		return
+	}
+
+	ok = tag.RowsAffected() == 1
+
+	return
+}
+
+// DeleteExpiredPasskeyCeremonies forgets finished ceremonies whose tokens
+// have expired, as they can't be replayed any more.
+func (p *Pool) DeleteExpiredPasskeyCeremonies(ctx context.Context) (count int64, err error) {
+	tag, err := p.Exec(ctx, `
+		DELETE FROM used_passkey_ceremonies WHERE expires_at <= $1;`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return
+	}
+
+	count = tag.RowsAffected()
+
+	return
+}
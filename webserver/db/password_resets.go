@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+// InsertPasswordReset stores a reset token for a user. Only a hash of the
+// token is stored.
+func (p *Pool) InsertPasswordReset(ctx context.Context, tokenHash []byte, userUUID uuid.UUID, expiresAt time.Time) (err error) {
+	if _, err = p.Exec(ctx, `
+		INSERT INTO password_resets
+		(token_hash, user_uuid, created_at, expires_at)
+		VALUES ($1, $2, $3, $4);`,
+		tokenHash, userUUID, time.Now().UTC(), expiresAt,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// PasswordResetExists checks whether tokenHash belongs to an unexpired
+// reset without using it up.
+func (p *Pool) PasswordResetExists(ctx context.Context, tokenHash []byte) (exists bool, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM password_resets
+			WHERE token_hash = $1
+			AND expires_at > $2
+		);`,
+		tokenHash, time.Now().UTC(),
+	)
+
+	err = row.Scan(&exists)
+
+	return
+}
+
+// ResetPassword sets a new password for the user owning the unexpired
+// reset matching tokenHash. All of that user's resets are used up, their
+// sessions are revoked and any token issued to them before now stops
+// being accepted. pgx.ErrNoRows is
+// returned if there is no such reset.
+func (p *Pool) ResetPassword(ctx context.Context, tokenHash []byte, plaintextPassword string) (userUUID uuid.UUID, err error) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+
+	row := tx.QueryRow(ctx, `
+		DELETE FROM password_resets
+		WHERE token_hash = $1
+		AND expires_at > $2
+		RETURNING user_uuid;`,
+		tokenHash, now,
+	)
+	if err = row.Scan(&userUUID); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM password_resets WHERE user_uuid = $1;`,
+		userUUID,
+	); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		UPDATE users
+		SET password = $1, tokens_valid_after = $2,
+		    failed_login_count = 0, last_failed_login_at = NULL, locked_until = NULL
+		WHERE uuid = $3;`,
+		string(passwordHash), now, userUUID,
+	); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE user_uuid = $2
+		AND revoked_at IS NULL;`,
+		now, userUUID,
+	); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+// DeleteExpiredPasswordResets removes resets that were never used.
+func (p *Pool) DeleteExpiredPasswordResets(ctx context.Context) (count int64, err error) {
+	tag, err := p.Exec(ctx, `
+		DELETE FROM password_resets WHERE expires_at <= $1;`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return
+	}
+
+	count = tag.RowsAffected()
+
+	return
+}
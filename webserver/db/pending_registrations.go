@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+// PendingRegistration is an account waiting for its email address to be
+// confirmed. Only a hash of the confirmation token is stored.
+type PendingRegistration struct {
+	TokenHash    []byte
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	Email        string
+	PasswordHash string
+	FirstName    string
+	LastName     string
+}
+
+type InsertPendingRegistrationContext struct {
+	TokenHash         []byte
+	ExpiresAt         time.Time
+	Email             string
+	PlaintextPassword string
+	FirstName         string
+	LastName          string
+}
+
+var EmailAlreadyRegisteredError = errors.New("email already registered")
+
+func (p *Pool) InsertPendingRegistration(ctx context.Context, regCtx *InsertPendingRegistrationContext) (registration *PendingRegistration, err error) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(regCtx.PlaintextPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+
+	registration = &PendingRegistration{
+		TokenHash:    regCtx.TokenHash,
+		CreatedAt:    time.Now().UTC(),
+		ExpiresAt:    regCtx.ExpiresAt,
+		Email:        regCtx.Email,
+		PasswordHash: string(passwordHash),
+		FirstName:    regCtx.FirstName,
+		LastName:     regCtx.LastName,
+	}
+
+	if _, err = p.Exec(ctx, `
+		INSERT INTO pending_registrations
+		(token_hash, created_at, expires_at, email,
+		 password, first_name, last_name)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		registration.TokenHash, registration.CreatedAt, registration.ExpiresAt,
+		registration.Email, registration.PasswordHash,
+		registration.FirstName, registration.LastName,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// PendingRegistrationExists checks whether tokenHash belongs to an
+// unexpired registration without using it up.
+func (p *Pool) PendingRegistrationExists(ctx context.Context, tokenHash []byte) (exists bool, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pending_registrations
+			WHERE token_hash = $1
+			AND expires_at > $2
+		);`,
+		tokenHash, time.Now().UTC(),
+	)
+
+	err = row.Scan(&exists)
+
+	return
+}
+
+// ConsumePendingRegistration turns the unexpired registration matching
+// tokenHash into a user. Every pending registration for the same email
+// address is removed, so a confirmation link only ever works once.
+// pgx.ErrNoRows is returned if there is no such registration.
+func (p *Pool) ConsumePendingRegistration(ctx context.Context, tokenHash []byte) (user *User, err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+
+	row := tx.QueryRow(ctx, `
+		DELETE FROM pending_registrations
+		WHERE token_hash = $1
+		AND expires_at > $2
+		RETURNING email, password, first_name, last_name;`,
+		tokenHash, now,
+	)
+
+	userUUID, err := uuid.NewRandom()
+	if err != nil {
+		return
+	}
+
+	user = &User{
+		UUID:      userUUID,
+		CreatedAt: now,
+		Role:      UserRoleUser,
+	}
+	if err = row.Scan(
+		&user.Email,
+		&user.PasswordHash,
+		&user.FirstName,
+		&user.LastName,
+	); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM pending_registrations WHERE email = $1;`,
+		user.Email,
+	); err != nil {
+		return
+	}
+
+	var exists bool
+	if err = tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM users WHERE email = $1);`,
+		user.Email,
+	).Scan(&exists); err != nil {
+		return
+	}
+
+	if exists {
+		err = EmailAlreadyRegisteredError
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO users
+		(uuid, created_at, email,
+		 password, first_name, last_name, role)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		user.UUID, user.CreatedAt,
+		user.Email, user.PasswordHash,
+		user.FirstName, user.LastName, user.Role,
+	); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+// DeleteExpiredPendingRegistrations removes registrations that were never
+// confirmed.
+func (p *Pool) DeleteExpiredPendingRegistrations(ctx context.Context) (count int64, err error) {
+	tag, err := p.Exec(ctx, `
+		DELETE FROM pending_registrations WHERE expires_at <= $1;`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return
+	}
+
+	count = tag.RowsAffected()
+
+	return
+}
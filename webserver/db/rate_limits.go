@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// RateLimitStore is a limiter.Store kept in Postgres, so every server
+// shares the same limits and they survive restarts. Each key gets a bucket
+// of tokens that refills all at once when its interval is up.
+type RateLimitStore struct {
+	pool *Pool
+
+	// name keeps the buckets of different limiters apart
+	name     string
+	tokens   uint64
+	interval time.Duration
+}
+
+// NewRateLimitStore makes a limiter allowing tokens requests per key in
+// every interval.
+func (p *Pool) NewRateLimitStore(name string, tokens uint64, interval time.Duration) *RateLimitStore {
+	return &RateLimitStore{
+		pool:     p,
+		name:     name,
+		tokens:   tokens,
+		interval: interval,
+	}
+}
+
+// Take uses up a token for key. A bucket left over from a previous interval
+// is refilled first. Once a bucket is empty its remaining count goes no
+// lower than -1, which marks the take as refused.
+func (s *RateLimitStore) Take(ctx context.Context, key string) (tokens, remaining, reset uint64, ok bool, err error) {
+	now := time.Now().UTC()
+
+	var bucketTokens, remainingInBucket int64
+	var resetAt time.Time
+	if err = s.pool.QueryRow(ctx, `
+		INSERT INTO rate_limits AS r
+		(name, key, tokens, interval_ms, remaining, reset_at)
+		VALUES ($1, $2, $3, $4, $3 - 1, $5::TIMESTAMPTZ + $4 * INTERVAL '1 millisecond')
+		ON CONFLICT (name, key) DO UPDATE
+		SET remaining = CASE
+		        WHEN r.reset_at <= $5 THEN r.tokens - 1
+		        ELSE GREATEST(r.remaining - 1, -1)
+		    END,
+		    reset_at = CASE
+		        WHEN r.reset_at <= $5 THEN $5::TIMESTAMPTZ + r.interval_ms * INTERVAL '1 millisecond'
+		        ELSE r.reset_at
+		    END
+		RETURNING tokens, remaining, reset_at;`,
+		s.name, key, int64(s.tokens), s.interval.Milliseconds(), now,
+	).Scan(&bucketTokens, &remainingInBucket, &resetAt); err != nil {
+		return
+	}
+
+	tokens = uint64(bucketTokens)
+	ok = remainingInBucket >= 0
+	remaining = uint64(max(remainingInBucket, 0))
+	reset = uint64(resetAt.UnixNano())
+
+	return
+}
+
+// Get reports the limit and remaining tokens for key without taking one.
+func (s *RateLimitStore) Get(ctx context.Context, key string) (tokens, remaining uint64, err error) {
+	var bucketTokens, remainingInBucket int64
+	var resetAt time.Time
+	if err = s.pool.QueryRow(ctx, `
+		SELECT tokens, remaining, reset_at
+		FROM rate_limits
+		WHERE name = $1
+		AND key = $2;`,
+		s.name, key,
+	).Scan(&bucketTokens, &remainingInBucket, &resetAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+
+	tokens = uint64(bucketTokens)
+	if !resetAt.After(time.Now()) {
+		return tokens, tokens, nil
+	}
+
+	remaining = uint64(max(remainingInBucket, 0))
+
+	return
+}
+
+// Set gives key its own limit, starting with a full bucket.
+func (s *RateLimitStore) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) (err error) {
+	now := time.Now().UTC()
+
+	if _, err = s.pool.Exec(ctx, `
+		INSERT INTO rate_limits
+		(name, key, tokens, interval_ms, remaining, reset_at)
+		VALUES ($1, $2, $3, $4, $3, $5)
+		ON CONFLICT (name, key) DO UPDATE
+		SET tokens = EXCLUDED.tokens,
+		    interval_ms = EXCLUDED.interval_ms,
+		    remaining = EXCLUDED.remaining,
+		    reset_at = EXCLUDED.reset_at;`,
+		s.name, key, int64(tokens), interval.Milliseconds(), now.Add(interval),
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// Burst adds tokens to key's bucket until its interval is up.
+func (s *RateLimitStore) Burst(ctx context.Context, key string, tokens uint64) (err error) {
+	now := time.Now().UTC()
+
+	if _, err = s.pool.Exec(ctx, `
+		INSERT INTO rate_limits AS r
+		(name, key, tokens, interval_ms, remaining, reset_at)
+		VALUES ($1, $2, $3, $4, $3 + $5, $6::TIMESTAMPTZ + $4 * INTERVAL '1 millisecond')
+		ON CONFLICT (name, key) DO UPDATE
+		SET remaining = CASE
+		        WHEN r.reset_at <= $6 THEN r.tokens
+		        ELSE GREATEST(r.remaining, 0)
+		    END + $5,
+		    reset_at = CASE
+		        WHEN r.reset_at <= $6 THEN $6::TIMESTAMPTZ + r.interval_ms * INTERVAL '1 millisecond'
+		        ELSE r.reset_at
+		    END;`,
+		s.name, key, int64(s.tokens), s.interval.Milliseconds(), int64(tokens), now,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// Close does nothing, as the database pool belongs to the server.
+func (s *RateLimitStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// DeleteExpiredRateLimits removes buckets whose interval is up. They
+// would be refilled on their next use anyway.
+func (p *Pool) DeleteExpiredRateLimits(ctx context.Context) (count int64, err error) {
+	tag, err := p.Exec(ctx, `
+		DELETE FROM rate_limits WHERE reset_at <= $1;`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return
+	}
+
+	count = tag.RowsAffected()
+
+	return
+}
@@ -0,0 +1,289 @@
+-- Schema additions on top of the base users and cards tables.
+-- Every statement is idempotent so the file can be re-applied with psql.
+
+CREATE TABLE IF NOT EXISTS devices
+(
+    id            TEXT PRIMARY KEY,
+    created_at    TIMESTAMPTZ NOT NULL,
+    friendly_name TEXT        NOT NULL,
+    last_seen_at  TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS device_heartbeats
+(
+    id               BIGSERIAL PRIMARY KEY,
+    device_id        TEXT        NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    received_at      TIMESTAMPTZ NOT NULL,
+    firmware_version TEXT        NOT NULL,
+    uptime_ms        BIGINT      NOT NULL,
+    battery_mv       INTEGER,
+    wifi_rssi        INTEGER     NOT NULL,
+    wake_reason      TEXT        NOT NULL,
+    rfid_version     TEXT        NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS device_heartbeats_device_id_received_at_idx
+    ON device_heartbeats (device_id, received_at DESC);
+
+CREATE TABLE IF NOT EXISTS firmware_releases
+(
+    uuid            UUID PRIMARY KEY,
+    created_at      TIMESTAMPTZ NOT NULL,
+    version         TEXT        NOT NULL,
+    hardware        TEXT        NOT NULL,
+    size            BIGINT      NOT NULL,
+    sha256          BYTEA       NOT NULL,
+    signature       BYTEA       NOT NULL,
+    rollout_percent INTEGER     NOT NULL CHECK (rollout_percent BETWEEN 0 AND 100),
+    image           BYTEA       NOT NULL,
+    UNIQUE (hardware, version)
+);
+
+ALTER TABLE devices
+    ADD COLUMN IF NOT EXISTS pinned_firmware_uuid UUID
+        REFERENCES firmware_releases (uuid) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS device_configs
+(
+    device_id  TEXT PRIMARY KEY REFERENCES devices (id) ON DELETE CASCADE,
+    config     JSONB       NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS unlock_commands
+(
+    uuid            UUID PRIMARY KEY,
+    device_id       TEXT        NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    requested_by    UUID        NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL,
+    expires_at      TIMESTAMPTZ NOT NULL,
+    delivered_at    TIMESTAMPTZ,
+    acknowledged_at TIMESTAMPTZ,
+    ack_result      TEXT
+);
+
+CREATE INDEX IF NOT EXISTS unlock_commands_device_id_created_at_idx
+    ON unlock_commands (device_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS device_events
+(
+    id          BIGSERIAL PRIMARY KEY,
+    device_id   TEXT        NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    received_at TIMESTAMPTZ NOT NULL,
+    type        TEXT        NOT NULL,
+    detail      TEXT        NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS device_events_device_id_received_at_idx
+    ON device_events (device_id, received_at DESC);
+
+ALTER TABLE devices
+    ADD COLUMN IF NOT EXISTS lock_state       TEXT NOT NULL DEFAULT 'unknown',
+    ADD COLUMN IF NOT EXISTS lock_state_since TIMESTAMPTZ;
+
+-- A threshold of 0 disables that alert for the device
+ALTER TABLE devices
+    ADD COLUMN IF NOT EXISTS owner_uuid             UUID,
+    ADD COLUMN IF NOT EXISTS alert_unlocked_minutes INTEGER NOT NULL DEFAULT 30,
+    ADD COLUMN IF NOT EXISTS alert_offline_hours    INTEGER NOT NULL DEFAULT 6,
+    ADD COLUMN IF NOT EXISTS alert_reader_errors    INTEGER NOT NULL DEFAULT 3;
+
+CREATE TABLE IF NOT EXISTS device_alerts
+(
+    uuid            UUID PRIMARY KEY,
+    device_id       TEXT        NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+    kind            TEXT        NOT NULL,
+    message         TEXT        NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL,
+    state           TEXT        NOT NULL,
+    acknowledged_at TIMESTAMPTZ,
+    acknowledged_by UUID,
+    resolved_at     TIMESTAMPTZ,
+    resolved_by     UUID
+);
+
+-- At most one unresolved alert of each kind per device
+CREATE UNIQUE INDEX IF NOT EXISTS device_alerts_active_idx
+    ON device_alerts (device_id, kind) WHERE state <> 'resolved';
+
+-- Promote the first admin with: UPDATE users SET role = 'admin' WHERE email = '...';
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+CREATE TABLE IF NOT EXISTS email_outbox
+(
+    uuid            UUID PRIMARY KEY,
+    created_at      TIMESTAMPTZ NOT NULL,
+    to_addrs        TEXT[]      NOT NULL,
+    subject         TEXT        NOT NULL,
+    html_body       TEXT        NOT NULL,
+    text_body       TEXT        NOT NULL,
+    status          TEXT        NOT NULL,
+    attempts        INTEGER     NOT NULL,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error      TEXT        NOT NULL,
+    sent_at         TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS email_outbox_pending_idx
+    ON email_outbox (next_attempt_at) WHERE status = 'pending';
+
+-- Accounts waiting for their email address to be confirmed
+CREATE TABLE IF NOT EXISTS pending_registrations
+(
+    token_hash BYTEA PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    email      TEXT        NOT NULL,
+    password   TEXT        NOT NULL,
+    first_name TEXT        NOT NULL,
+    last_name  TEXT        NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS pending_registrations_email_idx
+    ON pending_registrations (email);
+
+CREATE INDEX IF NOT EXISTS pending_registrations_expires_at_idx
+    ON pending_registrations (expires_at);
+
+-- Tokens issued before tokens_valid_after are no longer accepted
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS tokens_valid_after TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS password_resets
+(
+    token_hash BYTEA PRIMARY KEY,
+    user_uuid  UUID        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_uuid_idx
+    ON password_resets (user_uuid);
+
+-- Email address changes waiting for the new address to be confirmed
+CREATE TABLE IF NOT EXISTS email_changes
+(
+    token_hash BYTEA PRIMARY KEY,
+    user_uuid  UUID        NOT NULL,
+    new_email  TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS email_changes_user_uuid_idx
+    ON email_changes (user_uuid);
+
+-- One row per login
+CREATE TABLE IF NOT EXISTS sessions
+(
+    id           UUID PRIMARY KEY,
+    user_uuid    UUID        NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL,
+    expires_at   TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ NOT NULL,
+    user_agent   TEXT        NOT NULL,
+    ip_address   TEXT        NOT NULL,
+    revoked_at   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_uuid_idx
+    ON sessions (user_uuid);
+
+-- Every refresh token issued for a session. A token is used up once it
+-- has been rotated, and presenting it again revokes the session.
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    id          UUID PRIMARY KEY,
+    session_id  UUID        NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    issued_at   TIMESTAMPTZ NOT NULL,
+    rotated_at  TIMESTAMPTZ,
+    replaced_by UUID
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx
+    ON refresh_tokens (session_id);
+
+-- Keys for signing session tokens, selected by the kid token header
+CREATE TABLE IF NOT EXISTS signing_keys
+(
+    kid        TEXT PRIMARY KEY,
+    algorithm  TEXT        NOT NULL,
+    secret     BYTEA       NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    retired_at TIMESTAMPTZ
+);
+
+-- totp_last_step is the time step of the last accepted code, so codes
+-- can't be replayed
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS totp_secret         BYTEA,
+    ADD COLUMN IF NOT EXISTS totp_pending_secret BYTEA,
+    ADD COLUMN IF NOT EXISTS totp_enabled_at     TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS totp_last_step      BIGINT;
+
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    user_uuid  UUID        NOT NULL,
+    code_hash  BYTEA       NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ,
+    PRIMARY KEY (user_uuid, code_hash)
+);
+
+-- Site-wide settings changed from the admin pages
+CREATE TABLE IF NOT EXISTS settings
+(
+    key        TEXT PRIMARY KEY,
+    value      TEXT        NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+-- WebAuthn credentials. credential holds the whole credential record as
+-- JSON, including the public key and signature counter.
+CREATE TABLE IF NOT EXISTS passkeys
+(
+    id           BYTEA PRIMARY KEY,
+    user_uuid    UUID        NOT NULL,
+    name         TEXT        NOT NULL,
+    credential   JSONB       NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS passkeys_user_uuid_idx
+    ON passkeys (user_uuid);
+
+-- When the user last proved who they are in a session. Sessions from
+-- before this column existed count as long ago, so sensitive actions ask
+-- for the password again.
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS authenticated_at TIMESTAMPTZ NOT NULL DEFAULT 'epoch';
+
+-- Wrong passwords since the last successful login, for throttling and
+-- locking accounts that are being guessed at
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS failed_login_count   INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_failed_login_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS locked_until         TIMESTAMPTZ;
+
+-- Rate limit buckets shared by every server. name is the limiter and key
+-- what is being limited, usually an IP address.
+CREATE TABLE IF NOT EXISTS rate_limits
+(
+    name        TEXT        NOT NULL,
+    key         TEXT        NOT NULL,
+    tokens      BIGINT      NOT NULL,
+    interval_ms BIGINT      NOT NULL,
+    remaining   BIGINT      NOT NULL,
+    reset_at    TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (name, key)
+);
+
+-- Passkey ceremonies that have been finished, kept until their tokens
+-- expire so each can only be finished once
+CREATE TABLE IF NOT EXISTS used_passkey_ceremonies
+(
+    id         UUID PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,312 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// Session is a login. Each refresh swaps its refresh token for a new one,
+// and together these make up the session's token family.
+type Session struct {
+	ID         uuid.UUID
+	UserUUID   uuid.UUID
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	UserAgent  string
+	IPAddress  string
+	RevokedAt  *time.Time
+
+	// AuthenticatedAt is when the user last proved who they are in this
+	// session, by logging in or re-entering their password
+	AuthenticatedAt time.Time
+}
+
+// IsActive reports whether the session can still be used.
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// InsertSession records a new session along with the first refresh token
+// of its family.
+func (p *Pool) InsertSession(ctx context.Context, session *Session, refreshTokenID uuid.UUID) (err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO sessions
+		(id, user_uuid, created_at, expires_at,
+		 last_used_at, user_agent, ip_address, authenticated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`,
+		session.ID, session.UserUUID, session.CreatedAt, session.ExpiresAt,
+		session.LastUsedAt, session.UserAgent, session.IPAddress, session.AuthenticatedAt,
+	); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO refresh_tokens
+		(id, session_id, issued_at)
+		VALUES ($1, $2, $3);`,
+		refreshTokenID, session.ID, session.CreatedAt,
+	); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+var (
+	// RefreshTokenReusedError means a refresh token that had already been
+	// swapped for a new one was presented again. Its whole session has
+	// been revoked.
+	RefreshTokenReusedError = errors.New("refresh token reused")
+
+	SessionInactiveError = errors.New("session revoked or expired")
+)
+
+// RotateRefreshToken uses up a refresh token, replacing it with newTokenID
+// in the same session, and records where the session was used from.
+// tokenID is the refresh token the client should hold from now on. A token
+// that was rotated less than reuseGrace ago gives its existing replacement
+// instead, as parallel requests and lost responses present it again
+// without it having been stolen. pgx.ErrNoRows is returned for an unknown
+// token.
+func (p *Pool) RotateRefreshToken(ctx context.Context, oldTokenID uuid.UUID, newTokenID uuid.UUID, reuseGrace time.Duration, userAgent string, ipAddress string) (session *Session, tokenID uuid.UUID, err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+
+	var sessionID uuid.UUID
+	var rotatedAt *time.Time
+	var replacedBy *uuid.UUID
+	if err = tx.QueryRow(ctx, `
+		SELECT session_id, rotated_at, replaced_by
+		FROM refresh_tokens
+		WHERE id = $1
+		FOR UPDATE;`,
+		oldTokenID,
+	).Scan(&sessionID, &rotatedAt, &replacedBy); err != nil {
+		return
+	}
+
+	tokenID = newTokenID
+
+	reissued := rotatedAt != nil && replacedBy != nil && now.Sub(*rotatedAt) < reuseGrace
+	if reissued {
+		tokenID = *replacedBy
+	}
+
+	// Only one holder of the family can have the latest token, so a
+	// replayed one means it has been copied. End the session for both.
+	if rotatedAt != nil && !reissued {
+		if _, err = tx.Exec(ctx, `
+			UPDATE sessions
+			SET revoked_at = $1
+			WHERE id = $2
+			AND revoked_at IS NULL;`,
+			now, sessionID,
+		); err != nil {
+			return
+		}
+
+		if err = tx.Commit(ctx); err != nil {
+			return
+		}
+
+		err = RefreshTokenReusedError
+		return
+	}
+
+	if session, err = scanSession(tx.QueryRow(ctx, `
+		UPDATE sessions
+		SET last_used_at = $1, user_agent = $2, ip_address = $3
+		WHERE id = $4
+		RETURNING
+		id, user_uuid, created_at, expires_at,
+		last_used_at, user_agent, ip_address, revoked_at,
+		authenticated_at;`,
+		now, userAgent, ipAddress, sessionID,
+	)); err != nil {
+		return
+	}
+
+	if !session.IsActive() {
+		err = SessionInactiveError
+		return
+	}
+
+	if reissued {
+		if err = tx.Commit(ctx); err != nil {
+			return
+		}
+
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		UPDATE refresh_tokens
+		SET rotated_at = $1, replaced_by = $2
+		WHERE id = $3;`,
+		now, newTokenID, oldTokenID,
+	); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO refresh_tokens
+		(id, session_id, issued_at)
+		VALUES ($1, $2, $3);`,
+		newTokenID, sessionID, now,
+	); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *Pool) SelectSession(ctx context.Context, sessionID uuid.UUID) (session *Session, err error) {
+	return scanSession(p.QueryRow(ctx, `
+		SELECT
+		id, user_uuid, created_at, expires_at,
+		last_used_at, user_agent, ip_address, revoked_at,
+		authenticated_at
+		FROM sessions
+		WHERE id = $1;`, sessionID))
+}
+
+func scanSession(row pgx.Row) (session *Session, err error) {
+	session = &Session{}
+	if err = row.Scan(
+		&session.ID,
+		&session.UserUUID,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+		&session.LastUsedAt,
+		&session.UserAgent,
+		&session.IPAddress,
+		&session.RevokedAt,
+		&session.AuthenticatedAt,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// ListActiveSessions lists a user's unrevoked, unexpired sessions, most
+// recently used first.
+func (p *Pool) ListActiveSessions(ctx context.Context, userUUID uuid.UUID) (sessions []*Session, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT
+		id, user_uuid, created_at, expires_at,
+		last_used_at, user_agent, ip_address, revoked_at,
+		authenticated_at
+		FROM sessions
+		WHERE user_uuid = $1
+		AND revoked_at IS NULL
+		AND expires_at > $2
+		ORDER BY last_used_at DESC;`,
+		userUUID, time.Now().UTC(),
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	sessions = make([]*Session, 0, 8)
+	for rows.Next() {
+		var session *Session
+		if session, err = scanSession(rows); err != nil {
+			return
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// UpdateSessionAuthenticatedAt records that the user of a session has
+// just proved who they are again.
+func (p *Pool) UpdateSessionAuthenticatedAt(ctx context.Context, sessionID uuid.UUID, userUUID uuid.UUID, authenticatedAt time.Time) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE sessions
+		SET authenticated_at = $1
+		WHERE id = $2
+		AND user_uuid = $3;`,
+		authenticatedAt, sessionID, userUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// RevokeSession ends one of a user's sessions.
+func (p *Pool) RevokeSession(ctx context.Context, sessionID uuid.UUID, userUUID uuid.UUID) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE id = $2
+		AND user_uuid = $3
+		AND revoked_at IS NULL;`,
+		time.Now().UTC(), sessionID, userUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// RevokeUserSessions ends all of a user's sessions except keepSessionID,
+// which may be uuid.Nil to end every one.
+func (p *Pool) RevokeUserSessions(ctx context.Context, userUUID uuid.UUID, keepSessionID uuid.UUID) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE user_uuid = $2
+		AND id <> $3
+		AND revoked_at IS NULL;`,
+		time.Now().UTC(), userUUID, keepSessionID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// DeleteExpiredSessions removes sessions whose refresh token has expired.
+func (p *Pool) DeleteExpiredSessions(ctx context.Context) (count int64, err error) {
+	tag, err := p.Exec(ctx, `
+		DELETE FROM sessions WHERE expires_at <= $1;`,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return
+	}
+
+	count = tag.RowsAffected()
+
+	return
+}
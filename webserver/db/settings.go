@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// SettingRequireAdminTOTP makes admins turn on two-factor authentication
+// before they can use the admin pages. It is "true" or "false".
+const SettingRequireAdminTOTP = "require_admin_totp"
+
+// SelectSetting reads a site-wide setting, returning "" if it was never
+// set.
+func (p *Pool) SelectSetting(ctx context.Context, key string) (value string, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT value FROM settings WHERE key = $1;`, key)
+
+	if err = row.Scan(&value); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+
+	return
+}
+
+func (p *Pool) UpsertSetting(ctx context.Context, key string, value string) (err error) {
+	if _, err = p.Exec(ctx, `
+		INSERT INTO settings
+		(key, value, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE
+		SET value = EXCLUDED.value, updated_at = EXCLUDED.updated_at;`,
+		key, value, time.Now().UTC(),
+	); err != nil {
+		return
+	}
+
+	return
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// SigningKey signs and verifies session tokens. The newest unretired key
+// signs new tokens, and every unretired key is accepted when verifying.
+type SigningKey struct {
+	KID       string
+	Algorithm string
+	Secret    []byte
+	CreatedAt time.Time
+	RetiredAt *time.Time
+}
+
+func (p *Pool) InsertSigningKey(ctx context.Context, key *SigningKey) (err error) {
+	if _, err = p.Exec(ctx, `
+		INSERT INTO signing_keys
+		(kid, algorithm, secret, created_at)
+		VALUES ($1, $2, $3, $4);`,
+		key.KID, key.Algorithm, key.Secret, key.CreatedAt,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// SelectFirstSigningKeyCreatedAt is when the oldest key, retired or not,
+// was made. It is nil if there are no keys yet.
+func (p *Pool) SelectFirstSigningKeyCreatedAt(ctx context.Context) (createdAt *time.Time, err error) {
+	if err = p.QueryRow(ctx, `
+		SELECT MIN(created_at) FROM signing_keys;`,
+	).Scan(&createdAt); err != nil {
+		return
+	}
+
+	return
+}
+
+// ListSigningKeys lists signing keys, newest first.
+func (p *Pool) ListSigningKeys(ctx context.Context, includeRetired bool) (keys []*SigningKey, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT
+		kid, algorithm, secret, created_at, retired_at
+		FROM signing_keys
+		WHERE $1 OR retired_at IS NULL
+		ORDER BY created_at DESC;`,
+		includeRetired,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	keys = make([]*SigningKey, 0, 4)
+	for rows.Next() {
+		key := &SigningKey{}
+		if err = rows.Scan(
+			&key.KID,
+			&key.Algorithm,
+			&key.Secret,
+			&key.CreatedAt,
+			&key.RetiredAt,
+		); err != nil {
+			return
+		}
+
+		keys = append(keys, key)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+// RetireSigningKeys retires every key that was superseded by a newer key
+// before supersededBefore. Tokens signed with a retired key are rejected.
+func (p *Pool) RetireSigningKeys(ctx context.Context, supersededBefore time.Time) (count int64, err error) {
+	tag, err := p.Exec(ctx, `
+		UPDATE signing_keys k
+		SET retired_at = $1
+		WHERE k.retired_at IS NULL
+		AND EXISTS (
+			SELECT 1 FROM signing_keys n
+			WHERE n.created_at > k.created_at
+			AND n.created_at < $2
+		);`,
+		time.Now().UTC(), supersededBefore,
+	)
+	if err != nil {
+		return
+	}
+
+	count = tag.RowsAffected()
+
+	return
+}
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// SetUserPendingTOTPSecret starts enrolling a user in two-factor
+// authentication. The secret is only used once a code from it has been
+// confirmed with EnableUserTOTP.
+func (p *Pool) SetUserPendingTOTPSecret(ctx context.Context, userUUID uuid.UUID, secret []byte) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE users
+		SET totp_pending_secret = $1
+		WHERE uuid = $2;`,
+		secret, userUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// EnableUserTOTP switches the user to their pending secret. step is the
+// time step of the code they confirmed with, so it can't be used again.
+// Any old recovery codes are replaced with recoveryCodeHashes.
+func (p *Pool) EnableUserTOTP(ctx context.Context, userUUID uuid.UUID, step int64, recoveryCodeHashes [][]byte) (err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `
+		UPDATE users
+		SET totp_secret = totp_pending_secret,
+		    totp_pending_secret = NULL,
+		    totp_enabled_at = $1,
+		    totp_last_step = $2
+		WHERE uuid = $3
+		AND totp_pending_secret IS NOT NULL;`,
+		time.Now().UTC(), step, userUUID,
+	); err != nil {
+		return
+	}
+
+	if err = replaceRecoveryCodes(ctx, tx, userUUID, recoveryCodeHashes); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+// DisableUserTOTP turns two-factor authentication off and throws away the
+// user's recovery codes.
+func (p *Pool) DisableUserTOTP(ctx context.Context, userUUID uuid.UUID) (err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `
+		UPDATE users
+		SET totp_secret = NULL,
+		    totp_pending_secret = NULL,
+		    totp_enabled_at = NULL,
+		    totp_last_step = NULL
+		WHERE uuid = $1;`,
+		userUUID,
+	); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM recovery_codes WHERE user_uuid = $1;`,
+		userUUID,
+	); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+// UseTOTPStep records that a code from time step was accepted. It reports
+// false if a code from that step or a later one was already used, so a
+// code can't be replayed.
+func (p *Pool) UseTOTPStep(ctx context.Context, userUUID uuid.UUID, step int64) (ok bool, err error) {
+	tag, err := p.Exec(ctx, `
+		UPDATE users
+		SET totp_last_step = $1
+		WHERE uuid = $2
+		AND (totp_last_step IS NULL OR totp_last_step < $1);`,
+		step, userUUID,
+	)
+	if err != nil {
+		return
+	}
+
+	ok = tag.RowsAffected() == 1
+
+	return
+}
+
+// UseRecoveryCode marks one of the user's recovery codes as used. It
+// reports false if the code doesn't exist or was already used.
+func (p *Pool) UseRecoveryCode(ctx context.Context, userUUID uuid.UUID, codeHash []byte) (ok bool, err error) {
+	tag, err := p.Exec(ctx, `
+		UPDATE recovery_codes
+		SET used_at = $1
+		WHERE user_uuid = $2
+		AND code_hash = $3
+		AND used_at IS NULL;`,
+		time.Now().UTC(), userUUID, codeHash,
+	)
+	if err != nil {
+		return
+	}
+
+	ok = tag.RowsAffected() == 1
+
+	return
+}
+
+func (p *Pool) CountUnusedRecoveryCodes(ctx context.Context, userUUID uuid.UUID) (count int, err error) {
+	row := p.QueryRow(ctx, `
+		SELECT COUNT(*) FROM recovery_codes
+		WHERE user_uuid = $1
+		AND used_at IS NULL;`,
+		userUUID,
+	)
+
+	err = row.Scan(&count)
+
+	return
+}
+
+// ReplaceRecoveryCodes throws away the user's recovery codes and stores
+// codeHashes in their place.
+func (p *Pool) ReplaceRecoveryCodes(ctx context.Context, userUUID uuid.UUID, codeHashes [][]byte) (err error) {
+	tx, err := p.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err = replaceRecoveryCodes(ctx, tx, userUUID, codeHashes); err != nil {
+		return
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return
+	}
+
+	return
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userUUID uuid.UUID, codeHashes [][]byte) (err error) {
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM recovery_codes WHERE user_uuid = $1;`,
+		userUUID,
+	); err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, codeHash := range codeHashes {
+		if _, err = tx.Exec(ctx, `
+			INSERT INTO recovery_codes
+			(user_uuid, code_hash, created_at)
+			VALUES ($1, $2, $3);`,
+			userUUID, codeHash, now,
+		); err != nil {
+			return
+		}
+	}
+
+	return
+}
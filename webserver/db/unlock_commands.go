@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"time"
+)
+
+// UnlockCommand is a request from the dashboard to open a device. The
+// rows double as the audit trail of who asked and what the device did.
+type UnlockCommand struct {
+	UUID             uuid.UUID
+	DeviceID         string
+	RequestedBy      uuid.UUID
+	RequestedByEmail string
+	CreatedAt        time.Time
+	ExpiresAt        time.Time
+	DeliveredAt      *time.Time
+	AcknowledgedAt   *time.Time
+	AckResult        *string
+}
+
+func (u *UnlockCommand) Status() string {
+	switch {
+	case u.AcknowledgedAt != nil:
+		return "Acknowledged"
+	case u.DeliveredAt != nil:
+		return "Delivered"
+	case time.Now().After(u.ExpiresAt):
+		return "Expired"
+	default:
+		return "Pending"
+	}
+}
+
+func (p *Pool) InsertUnlockCommand(ctx context.Context, deviceID string, requestedBy uuid.UUID, validFor time.Duration) (command *UnlockCommand, err error) {
+	commandUUID, err := uuid.NewRandom()
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	command = &UnlockCommand{
+		UUID:        commandUUID,
+		DeviceID:    deviceID,
+		RequestedBy: requestedBy,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(validFor),
+	}
+
+	if _, err = p.Exec(ctx, `
+		INSERT INTO unlock_commands
+		(uuid, device_id, requested_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5);`,
+		command.UUID, command.DeviceID, command.RequestedBy,
+		command.CreatedAt, command.ExpiresAt,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// ClaimUnlockCommand marks the oldest pending, unexpired command for a
+// device as delivered and returns it. err is pgx.ErrNoRows if there is none.
+// Each command is only ever handed out once.
+func (p *Pool) ClaimUnlockCommand(ctx context.Context, deviceID string) (command *UnlockCommand, err error) {
+	row := p.QueryRow(ctx, `
+		UPDATE unlock_commands
+		SET delivered_at = $2
+		WHERE uuid = (
+			SELECT uuid FROM unlock_commands
+			WHERE device_id = $1
+			AND delivered_at IS NULL
+			AND expires_at > $2
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING uuid, requested_by, created_at, expires_at, delivered_at;`,
+		deviceID, time.Now().UTC(),
+	)
+
+	command = &UnlockCommand{DeviceID: deviceID}
+	if err = row.Scan(
+		&command.UUID,
+		&command.RequestedBy,
+		&command.CreatedAt,
+		&command.ExpiresAt,
+		&command.DeliveredAt,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+var UnlockCommandNotFoundError = errors.New("unlock command not found or already acknowledged")
+
+// AcknowledgeUnlockCommand records the device's result for a delivered command.
+func (p *Pool) AcknowledgeUnlockCommand(ctx context.Context, deviceID string, commandUUID uuid.UUID, result string) (err error) {
+	tag, err := p.Exec(ctx, `
+		UPDATE unlock_commands
+		SET acknowledged_at = $1, ack_result = $2
+		WHERE uuid = $3
+		AND device_id = $4
+		AND delivered_at IS NOT NULL
+		AND acknowledged_at IS NULL;`,
+		time.Now().UTC(), result, commandUUID, deviceID,
+	)
+	if err != nil {
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		err = UnlockCommandNotFoundError
+		return
+	}
+
+	return
+}
+
+func (p *Pool) ListUnlockCommands(ctx context.Context, deviceID string, limit int) (commands []*UnlockCommand, err error) {
+	rows, err := p.Query(ctx, `
+		SELECT
+		c.uuid, c.requested_by, COALESCE(u.email, ''),
+		c.created_at, c.expires_at, c.delivered_at,
+		c.acknowledged_at, c.ack_result
+		FROM unlock_commands c
+		LEFT JOIN users u ON u.uuid = c.requested_by
+		WHERE c.device_id = $1
+		ORDER BY c.created_at DESC
+		LIMIT $2;`, deviceID, limit,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	commands = make([]*UnlockCommand, 0, limit)
+	for rows.Next() {
+		command := &UnlockCommand{DeviceID: deviceID}
+		if err = rows.Scan(
+			&command.UUID,
+			&command.RequestedBy,
+			&command.RequestedByEmail,
+			&command.CreatedAt,
+			&command.ExpiresAt,
+			&command.DeliveredAt,
+			&command.AcknowledgedAt,
+			&command.AckResult,
+		); err != nil {
+			return
+		}
+
+		commands = append(commands, command)
+	}
+
+	err = rows.Err()
+
+	return
+}
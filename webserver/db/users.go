@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 	"time"
 )
@@ -14,8 +15,42 @@ type User struct {
 	PasswordHash string
 	FirstName    string
 	LastName     string
+	Role         UserRole
+
+	// TokensValidAfter is set when every existing session must end, such
+	// as after a password reset
+	TokensValidAfter *time.Time
+
+	// TOTPSecret is set once two-factor authentication has been turned
+	// on. TOTPPendingSecret holds a secret that is still being enrolled.
+	TOTPSecret        []byte
+	TOTPPendingSecret []byte
+	TOTPEnabledAt     *time.Time
+
+	// FailedLoginCount counts wrong passwords since the last successful
+	// login or lockout. LockedUntil is set while the account is locked.
+	FailedLoginCount  int
+	LastFailedLoginAt *time.Time
+	LockedUntil       *time.Time
+}
+
+// IsLocked reports whether password logins are refused for now.
+func (u *User) IsLocked() bool {
+	return u.LockedUntil != nil && time.Now().Before(*u.LockedUntil)
+}
+
+// TOTPEnabled reports whether logging in needs a one-time code.
+func (u *User) TOTPEnabled() bool {
+	return u.TOTPSecret != nil
 }
 
+type UserRole string
+
+const (
+	UserRoleUser  UserRole = "user"
+	UserRoleAdmin UserRole = "admin"
+)
+
 type InsertUserContext struct {
 	Email             string
 	PlaintextPassword string
@@ -41,16 +76,17 @@ func (p *Pool) InsertUser(ctx context.Context, userCtx *InsertUserContext) (user
 		PasswordHash: string(passwordHash),
 		FirstName:    userCtx.FirstName,
 		LastName:     userCtx.LastName,
+		Role:         UserRoleUser,
 	}
 
 	if _, err = p.Exec(ctx, `
 		INSERT INTO users
 		(uuid, created_at, email, 
-		 password, first_name, last_name)
-		VALUES ($1, $2, $3, $4, $5, $6);`,
+		 password, first_name, last_name, role)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`,
 		user.UUID, user.CreatedAt,
 		user.Email, user.PasswordHash,
-		user.FirstName, user.LastName,
+		user.FirstName, user.LastName, user.Role,
 	); err != nil {
 		return
 	}
@@ -58,25 +94,113 @@ func (p *Pool) InsertUser(ctx context.Context, userCtx *InsertUserContext) (user
 	return
 }
 
-func (p *Pool) SelectUserByEmail(ctx context.Context, email string) (user *User, err error) {
-	row := p.QueryRow(ctx, `
-		SELECT 
-		uuid, created_at, password, 
-		first_name, last_name
-		FROM users
-		WHERE email = $1;`, email)
+const userColumns = `
+	uuid, created_at, email, password,
+	first_name, last_name, role,
+	tokens_valid_after,
+	totp_secret, totp_pending_secret, totp_enabled_at,
+	failed_login_count, last_failed_login_at, locked_until`
+
+const selectUser = `SELECT ` + userColumns + ` FROM users`
 
+func scanUser(row pgx.Row) (user *User, err error) {
 	user = &User{}
 	if err = row.Scan(
 		&user.UUID,
 		&user.CreatedAt,
+		&user.Email,
 		&user.PasswordHash,
 		&user.FirstName,
 		&user.LastName,
+		&user.Role,
+		&user.TokensValidAfter,
+		&user.TOTPSecret,
+		&user.TOTPPendingSecret,
+		&user.TOTPEnabledAt,
+		&user.FailedLoginCount,
+		&user.LastFailedLoginAt,
+		&user.LockedUntil,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *Pool) SelectUserByEmail(ctx context.Context, email string) (user *User, err error) {
+	return scanUser(p.QueryRow(ctx, selectUser+`
+		WHERE email = $1;`, email))
+}
+
+func (p *Pool) SelectUserByUUID(ctx context.Context, userUUID uuid.UUID) (user *User, err error) {
+	return scanUser(p.QueryRow(ctx, selectUser+`
+		WHERE uuid = $1;`, userUUID))
+}
+
+func (p *Pool) UpdateUserName(ctx context.Context, userUUID uuid.UUID, firstName string, lastName string) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE users
+		SET first_name = $1, last_name = $2
+		WHERE uuid = $3;`,
+		firstName, lastName, userUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+func (p *Pool) UpdateUserPassword(ctx context.Context, userUUID uuid.UUID, plaintextPassword string) (err error) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+
+	if _, err = p.Exec(ctx, `
+		UPDATE users
+		SET password = $1
+		WHERE uuid = $2;`,
+		string(passwordHash), userUUID,
+	); err != nil {
+		return
+	}
+
+	return
+}
+
+// ListUsers lists every user, ordered by email.
+func (p *Pool) ListUsers(ctx context.Context) (users []*User, err error) {
+	rows, err := p.Query(ctx, selectUser+`
+		ORDER BY email;`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	users = make([]*User, 0, 16)
+	for rows.Next() {
+		var user *User
+		if user, err = scanUser(rows); err != nil {
+			return
+		}
+
+		users = append(users, user)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (p *Pool) UpdateUserRole(ctx context.Context, userUUID uuid.UUID, role UserRole) (err error) {
+	if _, err = p.Exec(ctx, `
+		UPDATE users
+		SET role = $1
+		WHERE uuid = $2;`,
+		role, userUUID,
 	); err != nil {
 		return
 	}
-	user.Email = email
 
 	return
 }
@@ -86,3 +210,14 @@ func (p *Pool) CountNumberOfUsers(ctx context.Context) (count int64, err error)
 	err = row.Scan(&count)
 	return
 }
+
+// TokenIssuedBeforeReset reports whether a token issued at issuedAt was
+// invalidated by TokensValidAfter.
+func (u *User) TokenIssuedBeforeReset(issuedAt time.Time) bool {
+	if u.TokensValidAfter == nil {
+		return false
+	}
+
+	// Token timestamps only have second precision
+	return issuedAt.Before(u.TokensValidAfter.Truncate(time.Second))
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"lockbox-webserver/db"
+	"net/http"
+)
+
+func (s *HTTPServer) handleGetAdminPage(c *gin.Context) {
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "admin", nil)
+}
+
+func (s *HTTPServer) handleGetAdminSecurityPage(c *gin.Context) {
+	required, err := s.adminTOTPRequired(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type AdminSecurityPageData struct {
+		AlertMsg         string
+		RequireAdminTOTP bool
+	}
+
+	pageData := AdminSecurityPageData{
+		RequireAdminTOTP: required,
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "admin_security", &pageData)
+}
+
+func (s *HTTPServer) handleSetAdminSecurity(c *gin.Context) {
+	requireAdminTOTP := "false"
+	if c.PostForm("require_admin_totp") == "on" {
+		requireAdminTOTP = "true"
+	}
+
+	if err := s.dbPool.UpsertSetting(c, db.SettingRequireAdminTOTP, requireAdminTOTP); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/admin/security")
+}
+
+func (s *HTTPServer) handleGetAdminUsersPage(c *gin.Context) {
+	s.writeAdminUsersPage(c, http.StatusOK, "")
+}
+
+func (s *HTTPServer) writeAdminUsersPage(c *gin.Context, status int, alertMsg string) {
+	users, err := s.dbPool.ListUsers(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type AdminUsersPageData struct {
+		AlertMsg        string
+		Users           []*db.User
+		CurrentUserUUID uuid.UUID
+	}
+
+	pageData := AdminUsersPageData{
+		AlertMsg:        alertMsg,
+		Users:           users,
+		CurrentUserUUID: s.getAccessTokenFromContext(c).CustomClaims().UserUUID,
+	}
+
+	mainTemplateSet.WriteTemplate(c, status, "admin_users", &pageData)
+}
+
+func (s *HTTPServer) handleSetUserRole(c *gin.Context) {
+	userUUID, err := uuid.Parse(c.Param("userUUID"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	role := db.UserRole(c.PostForm("role"))
+	if role != db.UserRoleUser && role != db.UserRoleAdmin {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// Stops the last admin locking everyone out
+	if userUUID == s.getAccessTokenFromContext(c).CustomClaims().UserUUID {
+		s.writeAdminUsersPage(c, http.StatusBadRequest, "You can't change your own role")
+		return
+	}
+
+	if err = s.dbPool.UpdateUserRole(c, userUUID, role); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeAdminUsersPage(c, http.StatusOK, "Role updated")
+}
+
+func (s *HTTPServer) handleGetAdminEmailsPage(c *gin.Context) {
+	type AdminEmailsPageData struct {
+		AlertMsg string
+		Names    []string
+	}
+
+	pageData := AdminEmailsPageData{
+		Names: emailTemplateSet.Names(),
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "admin_emails", &pageData)
+}
+
+func (s *HTTPServer) renderEmailPreview(c *gin.Context) (name string, msg *MailMessage, ok bool) {
+	name, exists := c.Params.Get("name")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	data, exists := emailPreviewData[name]
+	if !exists {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	msg, err := emailTemplateSet.Render(name, data)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ok = true
+
+	return
+}
+
+func (s *HTTPServer) handleGetAdminEmailPreviewPage(c *gin.Context) {
+	name, msg, ok := s.renderEmailPreview(c)
+	if !ok {
+		return
+	}
+
+	type AdminEmailPreviewPageData struct {
+		AlertMsg string
+		Name     string
+		Message  *MailMessage
+	}
+
+	pageData := AdminEmailPreviewPageData{
+		Name:    name,
+		Message: msg,
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "admin_email_preview", &pageData)
+}
+
+// handleGetAdminEmailPreviewHTML serves the HTML body on its own so the
+// preview page can show it in an iframe.
+func (s *HTTPServer) handleGetAdminEmailPreviewHTML(c *gin.Context) {
+	_, msg, ok := s.renderEmailPreview(c)
+	if !ok {
+		return
+	}
+
+	// Emails are styled inline, and are shown framed in the preview page
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data: https:; frame-ancestors 'self'")
+	c.Header("X-Frame-Options", "SAMEORIGIN")
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(msg.HTML))
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"lockbox-webserver/db"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	deviceAlertCheckInterval = time.Minute
+
+	// readerErrorWindow is the period over which reader errors are counted.
+	readerErrorWindow = time.Hour
+)
+
+// checkDeviceAlerts raises an alert for every device whose door has been
+// left open, that has gone quiet, or whose reader keeps failing, and
+// emails the device owner about each new alert.
+func (s *HTTPServer) checkDeviceAlerts(ctx context.Context) {
+	devices, err := s.dbPool.ListDevices(ctx)
+	if err != nil {
+		log.Printf("device alerts: unable to list devices: %v", err)
+		return
+	}
+
+	for _, device := range devices {
+		settings := device.AlertSettings
+
+		if settings.UnlockedMinutes > 0 &&
+			device.LockState == db.DeviceLockStateUnlocked &&
+			device.LockStateDuration() > time.Duration(settings.UnlockedMinutes)*time.Minute {
+			s.raiseDeviceAlert(ctx, device, db.DeviceAlertDoorOpen,
+				fmt.Sprintf("Door has been open for %s", device.LockStateDuration()))
+		}
+
+		if settings.OfflineHours > 0 &&
+			device.IsOffline(time.Duration(settings.OfflineHours)*time.Hour) {
+			s.raiseDeviceAlert(ctx, device, db.DeviceAlertOffline,
+				fmt.Sprintf("No heartbeat since %s", device.LastSeenAt.UTC().Format("Jan 02, 2006 15:04:05 UTC")))
+		}
+
+		if settings.ReaderErrors > 0 {
+			count, err := s.dbPool.CountDeviceEvents(ctx, device.ID, db.DeviceEventReaderError, time.Now().Add(-readerErrorWindow))
+			if err != nil {
+				log.Printf("device alerts: unable to count reader errors for %s: %v", device.ID, err)
+				continue
+			}
+
+			if count >= settings.ReaderErrors {
+				s.raiseDeviceAlert(ctx, device, db.DeviceAlertReaderErrors,
+					fmt.Sprintf("%d reader errors in the last %s", count, readerErrorWindow))
+			}
+		}
+	}
+}
+
+func (s *HTTPServer) raiseDeviceAlert(ctx context.Context, device *db.Device, kind db.DeviceAlertKind, message string) {
+	alert, err := s.dbPool.OpenDeviceAlert(ctx, device.ID, kind, message)
+	if err != nil {
+		log.Printf("device alerts: unable to open %s alert for %s: %v", kind, device.ID, err)
+		return
+	}
+
+	// Already raised and not yet resolved
+	if alert == nil {
+		return
+	}
+
+	if err = s.notifyDeviceOwner(ctx, device, alert); err != nil {
+		log.Printf("device alerts: unable to notify owner of %s: %v", device.ID, err)
+		return
+	}
+}
+
+func (s *HTTPServer) notifyDeviceOwner(ctx context.Context, device *db.Device, alert *db.DeviceAlert) (err error) {
+	if device.OwnerEmail == "" {
+		return
+	}
+
+	msg, err := emailTemplateSet.Render("device_alert", &deviceAlertEmailData{
+		DeviceName: device.FriendlyName,
+		Message:    alert.Message,
+		DeviceURL:  s.hostname + "/app/dashboard/devices/" + device.ID,
+	})
+	if err != nil {
+		return
+	}
+	msg.To = []string{device.OwnerEmail}
+
+	if err = s.enqueueMail(ctx, msg); err != nil {
+		return
+	}
+
+	return
+}
+
+func (s *HTTPServer) handleDashboardAcknowledgeAlert(c *gin.Context) {
+	s.updateDeviceAlert(c, s.dbPool.AcknowledgeDeviceAlert)
+}
+
+func (s *HTTPServer) handleDashboardResolveAlert(c *gin.Context) {
+	s.updateDeviceAlert(c, s.dbPool.ResolveDeviceAlert)
+}
+
+func (s *HTTPServer) updateDeviceAlert(c *gin.Context, update func(ctx context.Context, alertUUID uuid.UUID, userUUID uuid.UUID, anyDevice bool) (bool, error)) {
+	alertUUIDStr, exists := c.Params.Get("alertUUID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	alertUUID, err := uuid.Parse(alertUUIDStr)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Admins can handle alerts on any device, everyone else only on their own
+	ok, err := update(c, alertUUID, user.UUID, user.Role == db.UserRoleAdmin)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// Send the user back to whichever page they acted from
+	redirectTo := "/app/dashboard"
+	if deviceID := c.PostForm("device_id"); deviceID != "" {
+		redirectTo = "/app/dashboard/devices/" + deviceID
+	}
+
+	c.Redirect(http.StatusFound, redirectTo)
+}
+
+func (s *HTTPServer) handleDashboardClaimDevice(c *gin.Context) {
+	deviceID, exists := c.Params.Get("deviceID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Only admins can take a device from its owner, as its alerts would
+	// stop reaching them
+	ok, err := s.dbPool.SetDeviceOwner(c, deviceID, user.UUID, user.Role == db.UserRoleAdmin)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if !ok {
+		s.writeDevicePage(c, http.StatusConflict, deviceID, "This device already has an owner")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/devices/"+deviceID)
+}
+
+func (s *HTTPServer) handleDashboardSetAlertSettings(c *gin.Context) {
+	deviceID, exists := c.Params.Get("deviceID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	settings := db.DeviceAlertSettings{}
+	for field, dest := range map[string]*int{
+		"unlocked_minutes": &settings.UnlockedMinutes,
+		"offline_hours":    &settings.OfflineHours,
+		"reader_errors":    &settings.ReaderErrors,
+	} {
+		value, err := strconv.Atoi(c.PostForm(field))
+		if err != nil || value < 0 {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		*dest = value
+	}
+
+	if _, user := s.selectManagedDevice(c, deviceID); user == nil {
+		return
+	}
+
+	if err := s.dbPool.SetDeviceAlertSettings(c, deviceID, &settings); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/devices/"+deviceID)
+}
@@ -1,20 +1,38 @@
 package web
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"github.com/gin-gonic/gin"
-	"github.com/resend/resend-go/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 	"lockbox-webserver/db"
+	"log"
 	"net/http"
 	"time"
 )
 
-type NewAccountContext struct {
-	Email    string
-	Password string
-}
+const (
+	accessTokenDuration  = 15 * time.Minute
+	refreshTokenDuration = 24 * time.Hour
+
+	// rememberMeRefreshTokenDuration replaces refreshTokenDuration when
+	// "remember me" is ticked at login.
+	rememberMeRefreshTokenDuration = 30 * refreshTokenDuration
+
+	// refreshTokenReuseGrace is how long a refresh token can still be
+	// used after it was rotated, for tabs refreshing at the same moment
+	// and responses that never reached the browser.
+	refreshTokenReuseGrace = 10 * time.Second
+
+	registrationValidFor = 24 * time.Hour
+
+	// expiredTokenCleanupInterval is how often unused registration,
+	// password reset and email change tokens are swept up.
+	expiredTokenCleanupInterval = time.Hour
+)
 
 func (s *HTTPServer) handleGetLoginPage(c *gin.Context) {
 	mainTemplateSet.WriteTemplate(c, http.StatusOK, "login", nil)
@@ -28,25 +46,15 @@ func (s *HTTPServer) handleLoginSubmit(c *gin.Context) {
 	}
 
 	reqParams := RequestParams{}
-
-	if val, exists := c.Get("new_account"); exists {
-		newAccContext := val.(*NewAccountContext)
-		reqParams.Email = newAccContext.Email
-		reqParams.Password = newAccContext.Password
-	} else {
-		if err := c.ShouldBind(&reqParams); err != nil {
-			// Check if we have some context for a newly created account
-			c.AbortWithStatus(http.StatusBadRequest)
-			return
-		}
+	if err := c.ShouldBind(&reqParams); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
 	}
 
-	rememberMe := reqParams.RememberMe == "on"
-
 	// Load the user record
 	user, err := s.dbPool.SelectUserByEmail(c, reqParams.Email)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, pgx.ErrNoRows) {
 			mainTemplateSet.WriteTemplate(c,
 				http.StatusUnauthorized,
 				"login",
@@ -58,7 +66,23 @@ func (s *HTTPServer) handleLoginSubmit(c *gin.Context) {
 		return
 	}
 
+	// The password isn't even checked while the account is being throttled.
+	// The answer matches an unknown email so that it doesn't give away
+	// which accounts exist; the owner hears about a lockout by email.
+	if loginRetryAfter(user) > 0 {
+		mainTemplateSet.WriteTemplate(c,
+			http.StatusUnauthorized,
+			"login",
+			NewAlertMsg("Invalid email and/or password"))
+		return
+	}
+
 	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(reqParams.Password)) != nil {
+		if err = s.recordFailedLogin(c, user); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
 		mainTemplateSet.WriteTemplate(c,
 			http.StatusUnauthorized,
 			"login",
@@ -66,65 +90,145 @@ func (s *HTTPServer) handleLoginSubmit(c *gin.Context) {
 		return
 	}
 
-	// Build token cookies
-	accessTokenDuration := 15 * time.Minute
-	refreshTokenDuration := 24 * time.Hour
-	if rememberMe {
-		refreshTokenDuration *= 30 // ~ 30 days
+	if user.FailedLoginCount > 0 || user.LockedUntil != nil {
+		if err = s.dbPool.ClearFailedLogins(c, user.UUID); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
 	}
 
-	accessToken, err := MakeToken(JwtCustomFields{
-		Type:      JwtTokenTypeAccess,
-		Email:     user.Email,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
-	}, accessTokenDuration)
-	if err != nil {
+	rememberMe := reqParams.RememberMe == "on"
+
+	if user.TOTPEnabled() {
+		if err = s.startMFAChallenge(c, user, rememberMe); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err = s.startSession(c, user, rememberMe); err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	accessTokenStr, err := accessToken.SignedString(s.jwtSecretKey)
+
+	c.Redirect(http.StatusFound, "/app/dashboard")
+}
+
+// startSession logs user in by recording a new session and setting fresh
+// access and refresh token cookies for it.
+func (s *HTTPServer) startSession(c *gin.Context, user *db.User, rememberMe bool) (err error) {
+	refreshTokenValidFor := refreshTokenDuration
+	if rememberMe {
+		refreshTokenValidFor = rememberMeRefreshTokenDuration
+	}
+
+	sessionID, err := uuid.NewRandom()
 	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	refreshToken, err := MakeToken(JwtCustomFields{
 		Type:      JwtTokenTypeRefresh,
+		UserUUID:  user.UUID,
+		SessionID: sessionID,
+	}, refreshTokenValidFor)
+	if err != nil {
+		return
+	}
+
+	claims := refreshToken.CustomClaims()
+
+	refreshTokenID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return
+	}
+
+	if err = s.dbPool.InsertSession(c, &db.Session{
+		ID:              sessionID,
+		UserUUID:        user.UUID,
+		CreatedAt:       claims.IssuedAt.Time,
+		ExpiresAt:       claims.ExpiresAt.Time,
+		LastUsedAt:      claims.IssuedAt.Time,
+		UserAgent:       c.Request.UserAgent(),
+		IPAddress:       c.ClientIP(),
+		AuthenticatedAt: claims.IssuedAt.Time,
+	}, refreshTokenID); err != nil {
+		return
+	}
+
+	if err = s.issueAccessToken(c, user, sessionID, claims.IssuedAt.Time); err != nil {
+		return
+	}
+
+	if err = s.setRefreshTokenCookie(c, refreshToken); err != nil {
+		return
+	}
+
+	if err = s.setCSRFToken(c); err != nil {
+		return
+	}
+
+	return
+}
+
+func (s *HTTPServer) setRefreshTokenCookie(c *gin.Context, refreshToken *JwtToken) (err error) {
+	refreshTokenStr, err := s.keyring.Sign(refreshToken)
+	if err != nil {
+		return
+	}
+
+	s.setCookie(c,
+		"refresh_token",
+		refreshTokenStr,
+		int(time.Until(refreshToken.CustomClaims().ExpiresAt.Time).Seconds()))
+
+	return
+}
+
+// issueAccessToken sets an access token cookie carrying the current state
+// of user, and makes it the access token for the rest of the request.
+// authTime is when the user last proved who they are in the session.
+func (s *HTTPServer) issueAccessToken(c *gin.Context, user *db.User, sessionID uuid.UUID, authTime time.Time) (err error) {
+	accessToken, err := MakeToken(JwtCustomFields{
+		Type:      JwtTokenTypeAccess,
+		UserUUID:  user.UUID,
+		SessionID: sessionID,
 		Email:     user.Email,
 		FirstName: user.FirstName,
 		LastName:  user.LastName,
-	}, refreshTokenDuration)
+		AuthTime:  jwt.NewNumericDate(authTime),
+	}, accessTokenDuration)
 	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	refreshTokenStr, err := refreshToken.SignedString(s.jwtSecretKey)
+	accessTokenStr, err := s.keyring.Sign(accessToken)
 	if err != nil {
-		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	c.SetCookie(
-		"access_token",
-		accessTokenStr,
-		int(accessTokenDuration.Seconds()),
-		"", "", false, true,
-	)
+	s.setCookie(c, "access_token", accessTokenStr, int(accessTokenDuration.Seconds()))
 
-	c.SetCookie(
-		"refresh_token",
-		refreshTokenStr,
-		int(refreshTokenDuration.Seconds()),
-		"", "", false, true,
-	)
+	c.Set("access_token", accessToken)
 
-	c.Redirect(http.StatusFound, "/app/dashboard")
+	return
 }
 
 func (s *HTTPServer) handleGetLogout(c *gin.Context) {
-	c.SetCookie("access_token", "", -1, "", "", false, true)
-	c.SetCookie("refresh_token", "", -1, "", "", false, true)
+	// End the session server side too, so the refresh token can't be
+	// replayed
+	if refreshTokenStr, err := s.cookie(c, "refresh_token"); err == nil {
+		if refreshToken, err := ParseToken(refreshTokenStr, s.keyring); err == nil {
+			claims := refreshToken.CustomClaims()
+
+			if err = s.dbPool.RevokeSession(c, claims.SessionID, claims.UserUUID); err != nil {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	s.clearCookie(c, "access_token")
+	s.clearCookie(c, "refresh_token")
 
 	c.Redirect(http.StatusFound, "/app/login")
 }
@@ -157,46 +261,34 @@ func (s *HTTPServer) handleCreateAccountSubmit(c *gin.Context) {
 		return
 	}
 
-	registrationToken, err := MakeToken(JwtCustomFields{
-		Type:      JwtTokenTypeRegistration,
-		Email:     email,
-		FirstName: firstName,
-		LastName:  lastName,
-		Password:  password,
-	}, 15*time.Minute)
+	registrationToken, registrationTokenHash, err := newOpaqueToken()
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	registrationTokenStr, err := registrationToken.SignedString(s.jwtSecretKey)
-	if err != nil {
+	if _, err = s.dbPool.InsertPendingRegistration(c, &db.InsertPendingRegistrationContext{
+		TokenHash:         registrationTokenHash,
+		ExpiresAt:         time.Now().UTC().Add(registrationValidFor),
+		Email:             email,
+		PlaintextPassword: password,
+		FirstName:         firstName,
+		LastName:          lastName,
+	}); err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	type EmailBodyData struct {
-		AlertMsg        string
-		ConfirmationURL string
-	}
-
-	emailBodyData := EmailBodyData{
-		ConfirmationURL: s.hostname + "/app/confirmemail/" + registrationTokenStr,
-	}
-	emailBody, err := mainTemplateSet.FormatTemplate("email", &emailBodyData)
+	msg, err := emailTemplateSet.Render("confirm_email", &confirmEmailData{
+		ConfirmationURL: s.hostname + "/app/confirmemail/" + registrationToken,
+	})
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	msg.To = []string{email}
 
-	emailParams := &resend.SendEmailRequest{
-		From:    "No Reply <noreply@resend.reesenorr.is>",
-		To:      []string{email},
-		Html:    emailBody.String(),
-		Subject: "Confirm Lockbox Email",
-	}
-
-	if _, err = s.resendClient.Emails.Send(emailParams); err != nil {
+	if err = s.enqueueMail(c, msg); err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -204,6 +296,9 @@ func (s *HTTPServer) handleCreateAccountSubmit(c *gin.Context) {
 	mainTemplateSet.WriteTemplate(c, http.StatusOK, "check_email", nil)
 }
 
+// handleConfirmEmailPage asks the user to confirm their address with a
+// button rather than on the GET itself, so link scanners in mail clients
+// don't use up the link and log themselves in.
 func (s *HTTPServer) handleConfirmEmailPage(c *gin.Context) {
 	token, exists := c.Params.Get("token")
 	if !exists {
@@ -211,36 +306,90 @@ func (s *HTTPServer) handleConfirmEmailPage(c *gin.Context) {
 		return
 	}
 
-	registrationToken, err := ParseToken(token, s.jwtSecretKey)
+	valid, err := s.dbPool.PendingRegistrationExists(c, hashOpaqueToken(token))
 	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
 		mainTemplateSet.WriteTemplate(c,
 			http.StatusUnauthorized,
 			"create_account",
-			NewAlertMsg("Invalid registration details. Please try again later"))
+			NewAlertMsg("This confirmation link is invalid or has expired. Please try again"))
 		return
 	}
 
-	claims := registrationToken.CustomClaims()
+	type ConfirmEmailPageData struct {
+		AlertMsg string
+		Token    string
+	}
 
-	if claims.Type != JwtTokenTypeRegistration {
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "confirm_email", &ConfirmEmailPageData{
+		Token: token,
+	})
+}
+
+func (s *HTTPServer) handleConfirmEmailSubmit(c *gin.Context) {
+	token, exists := c.Params.Get("token")
+	if !exists {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	if _, err = s.dbPool.InsertUser(c, &db.InsertUserContext{
-		Email:             claims.Email,
-		PlaintextPassword: claims.Password,
-		FirstName:         claims.FirstName,
-		LastName:          claims.LastName,
-	}); err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
+	user, err := s.dbPool.ConsumePendingRegistration(c, hashOpaqueToken(token))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			mainTemplateSet.WriteTemplate(c,
+				http.StatusUnauthorized,
+				"create_account",
+				NewAlertMsg("This confirmation link is invalid or has expired. Please try again"))
+			return
+		}
+
+		if errors.Is(err, db.EmailAlreadyRegisteredError) {
+			mainTemplateSet.WriteTemplate(c,
+				http.StatusUnauthorized,
+				"create_account",
+				NewAlertMsg("Email already in use"))
+			return
+		}
+
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	c.Set("new_account", &NewAccountContext{
-		Email:    claims.Email,
-		Password: claims.Password,
-	})
+	if err = s.startSession(c, user, false); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard")
+}
 
-	s.handleLoginSubmit(c)
+// cleanupExpiredTokens removes registrations, password resets and email
+// changes that were never used, sessions, rate limit buckets and finished
+// passkey ceremonies that have expired, and old outbox emails.
+func (s *HTTPServer) cleanupExpiredTokens(ctx context.Context) {
+	for name, deleteExpired := range map[string]func(ctx context.Context) (int64, error){
+		"registrations":      s.dbPool.DeleteExpiredPendingRegistrations,
+		"password resets":    s.dbPool.DeleteExpiredPasswordResets,
+		"email changes":      s.dbPool.DeleteExpiredEmailChanges,
+		"sessions":           s.dbPool.DeleteExpiredSessions,
+		"rate limits":        s.dbPool.DeleteExpiredRateLimits,
+		"passkey ceremonies": s.dbPool.DeleteExpiredPasskeyCeremonies,
+		"outbox emails": func(ctx context.Context) (int64, error) {
+			return s.dbPool.DeleteOldOutboxEmails(ctx, outboxRetention)
+		},
+	} {
+		count, err := deleteExpired(ctx)
+		if err != nil {
+			log.Printf("cleanup: unable to delete expired %s: %v", name, err)
+			continue
+		}
+
+		if count > 0 {
+			log.Printf("cleanup: deleted %d expired %s", count, name)
+		}
+	}
 }
@@ -0,0 +1,21 @@
+package web
+
+import (
+	"context"
+	"time"
+)
+
+// runPeriodically calls task every interval until ctx is done.
+func runPeriodically(ctx context.Context, interval time.Duration, task func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			task(ctx)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cookieConfig holds the attributes every cookie is set with.
+type cookieConfig struct {
+	secure   bool
+	sameSite http.SameSite
+	domain   string
+
+	// hostPrefix names cookies with the __Host- prefix, so browsers only
+	// accept them when they are Secure, host-only and set for every path
+	hostPrefix bool
+}
+
+// newCookieConfigFromEnv reads cookie settings from COOKIE_SECURE,
+// COOKIE_SAMESITE (lax, strict or none), COOKIE_DOMAIN and
+// COOKIE_HOST_PREFIX. Cookies are Secure by default when hostname is
+// served over HTTPS.
+func newCookieConfigFromEnv(hostname string) (cfg cookieConfig, err error) {
+	cfg = cookieConfig{
+		secure:   strings.HasPrefix(hostname, "https://"),
+		sameSite: http.SameSiteLaxMode,
+		domain:   os.Getenv("COOKIE_DOMAIN"),
+	}
+
+	if secure := os.Getenv("COOKIE_SECURE"); secure != "" {
+		if cfg.secure, err = strconv.ParseBool(secure); err != nil {
+			return
+		}
+	}
+
+	switch sameSite := os.Getenv("COOKIE_SAMESITE"); strings.ToLower(sameSite) {
+	case "", "lax":
+	case "strict":
+		cfg.sameSite = http.SameSiteStrictMode
+	case "none":
+		cfg.sameSite = http.SameSiteNoneMode
+	default:
+		err = errors.New("unknown cookie SameSite mode: " + sameSite)
+		return
+	}
+
+	if hostPrefix := os.Getenv("COOKIE_HOST_PREFIX"); hostPrefix != "" {
+		if cfg.hostPrefix, err = strconv.ParseBool(hostPrefix); err != nil {
+			return
+		}
+	}
+
+	// Browsers drop cookies that break these rules, which would silently
+	// stop anyone logging in
+	if cfg.sameSite == http.SameSiteNoneMode && !cfg.secure {
+		err = errors.New("cookies with SameSite=None must be Secure")
+		return
+	}
+	if cfg.hostPrefix && (!cfg.secure || cfg.domain != "") {
+		err = errors.New("__Host- cookies must be Secure and have no domain")
+		return
+	}
+
+	return
+}
+
+// cookieName is the name a cookie is stored under in the browser.
+func (s *HTTPServer) cookieName(name string) string {
+	if s.cookies.hostPrefix {
+		return "__Host-" + name
+	}
+
+	return name
+}
+
+// setCookie sets an HttpOnly cookie for the whole site. A negative maxAge
+// deletes it, and zero makes it last as long as the browser session.
+func (s *HTTPServer) setCookie(c *gin.Context, name string, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     s.cookieName(name),
+		Value:    value,
+		MaxAge:   maxAge,
+		Path:     "/",
+		Domain:   s.cookies.domain,
+		Secure:   s.cookies.secure,
+		HttpOnly: true,
+		SameSite: s.cookies.sameSite,
+	})
+}
+
+// clearCookie deletes a cookie set by setCookie.
+func (s *HTTPServer) clearCookie(c *gin.Context, name string) {
+	s.setCookie(c, name, "", -1)
+}
+
+// cookie reads a cookie set by setCookie.
+func (s *HTTPServer) cookie(c *gin.Context, name string) (string, error) {
+	return c.Cookie(s.cookieName(name))
+}
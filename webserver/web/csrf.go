@@ -0,0 +1,61 @@
+package web
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// csrfTokenKey names both the CSRF cookie and the form field that has to
+// match it. Scripts send the token in the X-CSRF-Token header instead.
+const csrfTokenKey = "csrf_token"
+
+// setCSRFToken gives the browser a new CSRF token. It lasts as long as the
+// browser session, and is replaced whenever someone logs in so a token
+// planted before login is no use afterwards.
+func (s *HTTPServer) setCSRFToken(c *gin.Context) (err error) {
+	token, _, err := newOpaqueToken()
+	if err != nil {
+		return
+	}
+
+	s.setCookie(c, csrfTokenKey, token, 0)
+
+	c.Set(csrfTokenKey, token)
+
+	return
+}
+
+// csrfMiddleware makes sure every browser has a CSRF token for the forms
+// it's shown, and rejects any state changing request that doesn't carry
+// that token back.
+func (s *HTTPServer) csrfMiddleware(c *gin.Context) {
+	token, err := s.cookie(c, csrfTokenKey)
+	if err != nil || token == "" {
+		if err = s.setCSRFToken(c); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	} else {
+		c.Set(csrfTokenKey, token)
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+
+	submitted := c.GetHeader("X-CSRF-Token")
+	if submitted == "" {
+		submitted = c.PostForm(csrfTokenKey)
+	}
+
+	// A token that was only just made can't have been in a form
+	if token == "" || subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	c.Next()
+}
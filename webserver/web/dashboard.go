@@ -6,13 +6,12 @@ import (
 	"lockbox-webserver/db"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func (s *HTTPServer) handleGetDashboardPage(c *gin.Context) {
 
-	token := s.getAccessTokenFromContext(c)
-
-	user, err := s.dbPool.SelectUserByEmail(c, token.CustomClaims().Email)
+	user, err := s.selectCurrentUser(c)
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -24,15 +23,44 @@ func (s *HTTPServer) handleGetDashboardPage(c *gin.Context) {
 		return
 	}
 
+	devices, err := s.dbPool.ListDevices(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Each device's config says how soon it will pick up a remote unlock
+	configs := make(map[string]*DeviceConfig, len(devices))
+	for _, device := range devices {
+		if configs[device.ID], err = s.loadDeviceConfig(c, device.ID); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	alerts, err := s.dbPool.ListDeviceAlerts(c, "", true, 50)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
 	type DashboardPageData struct {
-		AlertMsg string
-		User     *db.User
-		Cards    []*db.Card
+		AlertMsg     string
+		User         *db.User
+		Cards        []*db.Card
+		Devices      []*db.Device
+		Configs      map[string]*DeviceConfig
+		Alerts       []*db.DeviceAlert
+		OfflineAfter time.Duration
 	}
 
 	pageData := DashboardPageData{
-		User:  user,
-		Cards: cards,
+		User:         user,
+		Cards:        cards,
+		Devices:      devices,
+		Configs:      configs,
+		Alerts:       alerts,
+		OfflineAfter: deviceOfflineAfter,
 	}
 
 	mainTemplateSet.WriteTemplate(c, http.StatusOK, "dashboard", &pageData)
@@ -108,6 +136,12 @@ func (s *HTTPServer) handleDashboardSetOpens(c *gin.Context) {
 		return
 	}
 
+	// A negative count lets the card open the lock forever
+	if numOpens < 0 && !s.recentlyAuthenticated(c) {
+		s.requireReauth(c, "/app/dashboard")
+		return
+	}
+
 	if err = s.dbPool.SetCardOpens(c, cardUUID, numOpens); err != nil {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
@@ -0,0 +1,138 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"time"
+)
+
+// DeviceConfig holds the hardware parameters a lockbox loads on every wake.
+// The binding tags are the schema every stored configuration must pass
+// before it is saved or served to a device.
+type DeviceConfig struct {
+	LockedAngle    int `json:"locked_angle" form:"locked_angle" binding:"min=0,max=180,nefield=UnlockedAngle"`
+	UnlockedAngle  int `json:"unlocked_angle" form:"unlocked_angle" binding:"min=0,max=180"`
+	ServoDwellMs   int `json:"servo_dwell_ms" form:"servo_dwell_ms" binding:"min=100,max=10000"`
+	PowerOnDelayMs int `json:"power_on_delay_ms" form:"power_on_delay_ms" binding:"min=0,max=5000"`
+	WiFiTimeoutMs  int `json:"wifi_timeout_ms" form:"wifi_timeout_ms" binding:"min=1000,max=60000"`
+
+	// HeartbeatIntervalS is capped so that a healthy device never
+	// trips deviceOfflineAfter.
+	HeartbeatIntervalS int `json:"heartbeat_interval_s" form:"heartbeat_interval_s" binding:"min=60,max=3600"`
+}
+
+// defaultDeviceConfig matches the values the firmware was built with.
+var defaultDeviceConfig = DeviceConfig{
+	LockedAngle:        89,
+	UnlockedAngle:      1,
+	ServoDwellMs:       1000,
+	PowerOnDelayMs:     100,
+	WiFiTimeoutMs:      10000,
+	HeartbeatIntervalS: 3600,
+}
+
+// CheckInInterval is the longest a sleeping device goes between check-ins,
+// and so how long a remote unlock may take to be picked up.
+func (config *DeviceConfig) CheckInInterval() time.Duration {
+	return time.Duration(config.HeartbeatIntervalS) * time.Second
+}
+
+func validateDeviceConfig(config *DeviceConfig) error {
+	return binding.Validator.ValidateStruct(config)
+}
+
+// loadDeviceConfig loads a device's configuration, falling back to the
+// defaults if it has never been configured.
+func (s *HTTPServer) loadDeviceConfig(c *gin.Context, deviceID string) (config *DeviceConfig, err error) {
+	config = &DeviceConfig{}
+	*config = defaultDeviceConfig
+
+	rawConfig, err := s.dbPool.SelectDeviceConfig(c, deviceID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+
+	if err = json.Unmarshal(rawConfig, config); err != nil {
+		return
+	}
+
+	return
+}
+
+func (s *HTTPServer) handleGetDeviceConfig(c *gin.Context) {
+	deviceID := c.Query("device_id")
+	if deviceID == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	config, err := s.loadDeviceConfig(c, deviceID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Never hand a device values outside the schema. It will keep
+	// running with its last known good configuration instead.
+	if err = validateDeviceConfig(config); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(config)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json", body)
+}
+
+func (s *HTTPServer) handleSetDeviceConfig(c *gin.Context) {
+	deviceID, exists := c.Params.Get("deviceID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if _, user := s.selectManagedDevice(c, deviceID); user == nil {
+		return
+	}
+
+	config := DeviceConfig{}
+	if err := c.ShouldBind(&config); err != nil {
+		s.writeDevicePage(c, http.StatusBadRequest, deviceID, "Invalid configuration: "+err.Error())
+		return
+	}
+
+	rawConfig, err := json.Marshal(&config)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.UpsertDeviceConfig(c, deviceID, rawConfig); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/devices/"+deviceID)
+}
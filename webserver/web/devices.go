@@ -0,0 +1,206 @@
+package web
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"lockbox-webserver/db"
+	"net/http"
+	"time"
+)
+
+// deviceOfflineAfter is how long a device may go without a heartbeat
+// before the dashboard reports it as offline. Devices wake up to send
+// a heartbeat once an hour, so this tolerates a couple of missed wakes.
+const deviceOfflineAfter = 3 * time.Hour
+
+func (s *HTTPServer) handleDeviceHeartbeat(c *gin.Context) {
+	type RequestBody struct {
+		DeviceID        string `json:"device_id" binding:"required,max=64"`
+		FirmwareVersion string `json:"firmware_version" binding:"required,max=32"`
+		UptimeMs        int64  `json:"uptime_ms" binding:"min=0"`
+		BatteryMv       *int   `json:"battery_mv" binding:"omitempty,min=0"`
+		WiFiRSSI        int    `json:"wifi_rssi"`
+		WakeReason      string `json:"wake_reason" binding:"required,max=32"`
+		RFIDVersion     string `json:"rfid_version" binding:"max=32"`
+	}
+
+	reqBody := RequestBody{}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.dbPool.RecordDeviceHeartbeat(c, &db.DeviceHeartbeat{
+		DeviceID:        reqBody.DeviceID,
+		ReceivedAt:      time.Now().UTC(),
+		FirmwareVersion: reqBody.FirmwareVersion,
+		UptimeMs:        reqBody.UptimeMs,
+		BatteryMv:       reqBody.BatteryMv,
+		WiFiRSSI:        reqBody.WiFiRSSI,
+		WakeReason:      reqBody.WakeReason,
+		RFIDVersion:     reqBody.RFIDVersion,
+	}); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *HTTPServer) handleDeviceEvent(c *gin.Context) {
+	type RequestBody struct {
+		DeviceID string             `json:"device_id" binding:"required,max=64"`
+		Type     db.DeviceEventType `json:"type" binding:"required,oneof=unlocked relocked button_wake reader_error"`
+		Detail   string             `json:"detail" binding:"max=256"`
+	}
+
+	reqBody := RequestBody{}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.dbPool.RecordDeviceEvent(c, &db.DeviceEvent{
+		DeviceID:   reqBody.DeviceID,
+		ReceivedAt: time.Now().UTC(),
+		Type:       reqBody.Type,
+		Detail:     reqBody.Detail,
+	}); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *HTTPServer) handleGetDevicePage(c *gin.Context) {
+	deviceID, exists := c.Params.Get("deviceID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	s.writeDevicePage(c, http.StatusOK, deviceID, "")
+}
+
+// canManageDevice reports whether user may control device and change its
+// settings. Only its owner and admins can.
+func canManageDevice(user *db.User, device *db.Device) bool {
+	return user.Role == db.UserRoleAdmin || device.IsOwnedBy(user.UUID)
+}
+
+// selectManagedDevice loads a device the current user can manage. If it
+// doesn't exist or they can't, the request is aborted and nil is returned.
+func (s *HTTPServer) selectManagedDevice(c *gin.Context, deviceID string) (device *db.Device, user *db.User) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	device, err = s.dbPool.SelectDevice(c, deviceID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil, nil
+		}
+
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	if !canManageDevice(user, device) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return nil, nil
+	}
+
+	return
+}
+
+// writeDevicePage renders the device page, optionally with an alert
+// explaining why a submitted form was rejected.
+func (s *HTTPServer) writeDevicePage(c *gin.Context, httpStatus int, deviceID string, alertMsg string) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	device, err := s.dbPool.SelectDevice(c, deviceID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	heartbeats, err := s.dbPool.ListDeviceHeartbeats(c, deviceID, 50)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	events, err := s.dbPool.ListDeviceEvents(c, deviceID, 50)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	releases, err := s.dbPool.ListFirmwareReleases(c, "")
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	config, err := s.loadDeviceConfig(c, deviceID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	unlockCommands, err := s.dbPool.ListUnlockCommands(c, deviceID, 20)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	alerts, err := s.dbPool.ListDeviceAlerts(c, deviceID, false, 20)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type DevicePageData struct {
+		AlertMsg         string
+		IsAdmin          bool
+		CanManage        bool
+		Device           *db.Device
+		Heartbeats       []*db.DeviceHeartbeat
+		Events           []*db.DeviceEvent
+		OfflineAfter     time.Duration
+		FirmwareReleases []*db.FirmwareRelease
+		Config           *DeviceConfig
+		UnlockCommands   []*db.UnlockCommand
+		Alerts           []*db.DeviceAlert
+	}
+
+	pageData := DevicePageData{
+		AlertMsg:         alertMsg,
+		IsAdmin:          user.Role == db.UserRoleAdmin,
+		CanManage:        canManageDevice(user, device),
+		Device:           device,
+		Heartbeats:       heartbeats,
+		Events:           events,
+		OfflineAfter:     deviceOfflineAfter,
+		FirmwareReleases: releases,
+		Config:           config,
+		UnlockCommands:   unlockCommands,
+		Alerts:           alerts,
+	}
+
+	mainTemplateSet.WriteTemplate(c, httpStatus, "device", &pageData)
+}
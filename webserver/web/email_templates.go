@@ -0,0 +1,177 @@
+package web
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates/email
+var emailTemplatesEmbed embed.FS
+
+var emailTemplateSet *EmailTemplateSet
+
+func init() {
+	var err error
+	if emailTemplateSet, err = NewEmailTemplateSet(
+		emailTemplatesEmbed, "templates/email", "layout",
+	); err != nil {
+		panic(err)
+	}
+}
+
+// EmailTemplateSet renders multipart emails. Every message is a pair of
+// files: name.txt defines the "subject" and the plain text "body", and
+// name.html defines the HTML "body". Each is wrapped in the matching
+// layout file.
+type EmailTemplateSet struct {
+	html map[string]*htmltemplate.Template
+	text map[string]*texttemplate.Template
+}
+
+func NewEmailTemplateSet(fs fs.ReadDirFS, path string, layoutName string) (templateSet *EmailTemplateSet, err error) {
+	path = strings.TrimSuffix(path, "/")
+
+	templateSet = &EmailTemplateSet{
+		html: make(map[string]*htmltemplate.Template),
+		text: make(map[string]*texttemplate.Template),
+	}
+
+	dir, err := fs.ReadDir(path)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range dir {
+		name, isHTML := strings.CutSuffix(entry.Name(), ".html")
+		if !isHTML || name == layoutName {
+			continue
+		}
+
+		templateSet.html[name] = htmltemplate.Must(htmltemplate.ParseFS(fs,
+			path+"/"+layoutName+".html", path+"/"+name+".html"))
+		templateSet.text[name] = texttemplate.Must(texttemplate.ParseFS(fs,
+			path+"/"+layoutName+".txt", path+"/"+name+".txt"))
+
+		if templateSet.text[name].Lookup("subject") == nil {
+			err = errors.New("email template " + name + " does not define a subject")
+			return
+		}
+	}
+
+	return
+}
+
+// Names lists every message the set can render, in alphabetical order.
+func (e *EmailTemplateSet) Names() (names []string) {
+	for name := range e.html {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return
+}
+
+// Render renders a message. The caller fills in the recipients.
+func (e *EmailTemplateSet) Render(key string, data any) (msg *MailMessage, err error) {
+	htmlTemplate, exists := e.html[key]
+	if !exists {
+		err = errors.New("email template does not exist")
+		return
+	}
+	textTemplate := e.text[key]
+
+	var subject, textBody, htmlBody bytes.Buffer
+	if err = textTemplate.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return
+	}
+	if err = textTemplate.Execute(&textBody, data); err != nil {
+		return
+	}
+	if err = htmlTemplate.Execute(&htmlBody, data); err != nil {
+		return
+	}
+
+	// Subjects end up in a mail header, so they must be a single line
+	subjectLine := strings.Join(strings.Fields(subject.String()), " ")
+
+	msg = &MailMessage{
+		Subject: subjectLine,
+		HTML:    htmlBody.String(),
+		Text:    strings.TrimSpace(textBody.String()) + "\n",
+	}
+
+	return
+}
+
+type confirmEmailData struct {
+	ConfirmationURL string
+}
+
+type deviceAlertEmailData struct {
+	DeviceName string
+	Message    string
+	DeviceURL  string
+}
+
+type passwordResetEmailData struct {
+	FirstName string
+	ResetURL  string
+	ValidFor  string
+}
+
+type accountLockedEmailData struct {
+	FirstName         string
+	LockedFor         string
+	ForgotPasswordURL string
+}
+
+type passkeyAddedEmailData struct {
+	FirstName   string
+	PasskeyName string
+	PasskeysURL string
+}
+
+type confirmEmailChangeData struct {
+	FirstName       string
+	NewEmail        string
+	ConfirmationURL string
+}
+
+// emailPreviewData is sample data for every email template, used by the
+// admin preview pages.
+var emailPreviewData = map[string]any{
+	"account_locked": &accountLockedEmailData{
+		FirstName:         "Alex",
+		LockedFor:         loginLockoutDuration.String(),
+		ForgotPasswordURL: "https://example.com/app/forgotpassword",
+	},
+	"confirm_email": &confirmEmailData{
+		ConfirmationURL: "https://example.com/app/confirmemail/preview",
+	},
+	"confirm_email_change": &confirmEmailChangeData{
+		FirstName:       "Alex",
+		NewEmail:        "alex@example.com",
+		ConfirmationURL: "https://example.com/app/confirmemailchange/preview",
+	},
+	"device_alert": &deviceAlertEmailData{
+		DeviceName: "Front Door",
+		Message:    "Door has been open for 45m0s",
+		DeviceURL:  "https://example.com/app/dashboard/devices/preview",
+	},
+	"passkey_added": &passkeyAddedEmailData{
+		FirstName:   "Alex",
+		PasskeyName: "Laptop",
+		PasskeysURL: "https://example.com/app/dashboard/passkeys",
+	},
+	"password_reset": &passwordResetEmailData{
+		FirstName: "Alex",
+		ResetURL:  "https://example.com/app/resetpassword/preview",
+		ValidFor:  passwordResetValidFor.String(),
+	},
+}
@@ -0,0 +1,350 @@
+package web
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"io"
+	"lockbox-webserver/db"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFirmwareImageSize is the largest image accepted for upload. It is
+// sized to the OTA app partition of a 4 MB flash chip.
+const maxFirmwareImageSize = 4 << 20
+
+// compareFirmwareVersions compares dotted version strings such as "0.2.0"
+// component by component. Numeric components compare numerically, anything
+// else falls back to a string comparison.
+func compareFirmwareVersions(a, b string) int {
+	aParts := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bParts := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < max(len(aParts), len(bParts)); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+
+		aNum, aErr := strconv.Atoi(aPart)
+		bNum, bErr := strconv.Atoi(bPart)
+		if aErr == nil && bErr == nil {
+			if aNum != bNum {
+				return aNum - bNum
+			}
+			continue
+		}
+
+		if cmp := strings.Compare(aPart, bPart); cmp != 0 {
+			return cmp
+		}
+	}
+
+	return 0
+}
+
+// inFirmwareRollout deterministically places a device into a bucket from
+// 0 to 99 for a release, so raising the percentage only ever adds devices.
+func inFirmwareRollout(release *db.FirmwareRelease, deviceID string) bool {
+	sum := sha256.Sum256(append(release.UUID[:], deviceID...))
+	bucket := binary.BigEndian.Uint16(sum[:2]) % 100
+	return int(bucket) < release.RolloutPercent
+}
+
+// selectFirmwareUpdate picks the release a device should be running, or nil
+// if it is already up to date. A pinned release always wins, even if it is
+// older than the running version.
+func (s *HTTPServer) selectFirmwareUpdate(c *gin.Context, deviceID string, hardware string, version string) (release *db.FirmwareRelease, err error) {
+	device, err := s.dbPool.SelectDevice(c, deviceID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return
+	}
+	err = nil
+
+	if device != nil && device.PinnedFirmwareUUID != nil {
+		var pinned *db.FirmwareRelease
+		if pinned, err = s.dbPool.SelectFirmwareRelease(c, *device.PinnedFirmwareUUID); err != nil {
+			return
+		}
+
+		if pinned.Hardware == hardware && pinned.Version != version {
+			release = pinned
+		}
+		return
+	}
+
+	releases, err := s.dbPool.ListFirmwareReleases(c, hardware)
+	if err != nil {
+		return
+	}
+
+	for _, candidate := range releases {
+		if compareFirmwareVersions(candidate.Version, version) <= 0 {
+			continue
+		}
+
+		if !inFirmwareRollout(candidate, deviceID) {
+			continue
+		}
+
+		if release == nil || compareFirmwareVersions(candidate.Version, release.Version) > 0 {
+			release = candidate
+		}
+	}
+
+	return
+}
+
+func (s *HTTPServer) handleFirmwareCheck(c *gin.Context) {
+	type RequestParams struct {
+		DeviceID string `form:"device_id" binding:"required,max=64"`
+		Hardware string `form:"hardware" binding:"required,max=32"`
+		Version  string `form:"version" binding:"required,max=32"`
+	}
+
+	reqParams := RequestParams{}
+	if err := c.ShouldBindQuery(&reqParams); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	release, err := s.selectFirmwareUpdate(c, reqParams.DeviceID, reqParams.Hardware, reqParams.Version)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if release == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	type ResponseBody struct {
+		Version   string `json:"version"`
+		URL       string `json:"url"`
+		Size      int64  `json:"size"`
+		SHA256    string `json:"sha256"`
+		Signature string `json:"signature"`
+	}
+
+	c.JSON(http.StatusOK, &ResponseBody{
+		Version:   release.Version,
+		URL:       s.hostname + "/api/devices/firmware/" + release.UUID.String(),
+		Size:      release.Size,
+		SHA256:    release.SHA256Hex(),
+		Signature: base64.StdEncoding.EncodeToString(release.Signature),
+	})
+}
+
+func (s *HTTPServer) handleDownloadFirmware(c *gin.Context) {
+	releaseUUIDStr, exists := c.Params.Get("releaseUUID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	releaseUUID, err := uuid.Parse(releaseUUIDStr)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	release, err := s.dbPool.SelectFirmwareRelease(c, releaseUUID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	image, err := s.dbPool.SelectFirmwareImage(c, releaseUUID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// ServeContent takes care of Range and If-None-Match requests
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("ETag", `"`+release.SHA256Hex()+`"`)
+	c.Header("X-Firmware-Version", release.Version)
+	c.Header("X-Firmware-Signature", base64.StdEncoding.EncodeToString(release.Signature))
+	http.ServeContent(c.Writer, c.Request, release.Version+".bin", release.CreatedAt, bytes.NewReader(image))
+}
+
+func (s *HTTPServer) handleGetFirmwarePage(c *gin.Context) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	releases, err := s.dbPool.ListFirmwareReleases(c, "")
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type FirmwarePageData struct {
+		AlertMsg       string
+		IsAdmin        bool
+		UploadsEnabled bool
+		Releases       []*db.FirmwareRelease
+	}
+
+	pageData := FirmwarePageData{
+		IsAdmin:        user.Role == db.UserRoleAdmin,
+		UploadsEnabled: s.firmwarePublicKey != nil,
+		Releases:       releases,
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "firmware", &pageData)
+}
+
+func (s *HTTPServer) handleUploadFirmware(c *gin.Context) {
+	// Without the release key there's no telling who built an image
+	if s.firmwarePublicKey == nil {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	type RequestParams struct {
+		Version   string `form:"version" binding:"required,max=32"`
+		Hardware  string `form:"hardware" binding:"required,max=32"`
+		Signature string `form:"signature" binding:"required"`
+	}
+
+	reqParams := RequestParams{}
+	if err := c.ShouldBind(&reqParams); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(reqParams.Signature))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	fileHeader, err := c.FormFile("image")
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if fileHeader.Size > maxFirmwareImageSize {
+		c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	image, err := io.ReadAll(io.LimitReader(file, maxFirmwareImageSize))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// Only accept images signed by the release key
+	if !ed25519.Verify(s.firmwarePublicKey, image, signature) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	releaseUUID, err := uuid.NewRandom()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(image)
+
+	// New releases start with no devices until a rollout is configured
+	if err = s.dbPool.InsertFirmwareRelease(c, &db.FirmwareRelease{
+		UUID:           releaseUUID,
+		CreatedAt:      time.Now().UTC(),
+		Version:        reqParams.Version,
+		Hardware:       reqParams.Hardware,
+		Size:           int64(len(image)),
+		SHA256:         sum[:],
+		Signature:      signature,
+		RolloutPercent: 0,
+	}, image); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/firmware")
+}
+
+func (s *HTTPServer) handleSetFirmwareRollout(c *gin.Context) {
+	releaseUUIDStr, exists := c.Params.Get("releaseUUID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	releaseUUID, err := uuid.Parse(releaseUUIDStr)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	percent, err := strconv.Atoi(c.PostForm("percent"))
+	if err != nil || percent < 0 || percent > 100 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if err = s.dbPool.SetFirmwareRolloutPercent(c, releaseUUID, percent); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/firmware")
+}
+
+func (s *HTTPServer) handleSetDevicePinnedFirmware(c *gin.Context) {
+	deviceID, exists := c.Params.Get("deviceID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// An empty release unpins the device
+	var releaseUUID *uuid.UUID
+	if releaseUUIDStr := c.PostForm("release"); releaseUUIDStr != "" {
+		parsed, err := uuid.Parse(releaseUUIDStr)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		releaseUUID = &parsed
+	}
+
+	if err := s.dbPool.SetDevicePinnedFirmware(c, deviceID, releaseUUID); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/devices/"+deviceID)
+}
@@ -0,0 +1,66 @@
+package web
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseNetworkList parses a comma separated list of networks in CIDR
+// notation. A bare address stands for just itself.
+func parseNetworkList(list string) (networks []netip.Prefix, err error) {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var network netip.Prefix
+		if strings.Contains(entry, "/") {
+			network, err = netip.ParsePrefix(entry)
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(entry); err == nil {
+				network = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid network %q: %w", entry, err)
+			return
+		}
+
+		networks = append(networks, network.Masked())
+	}
+
+	return
+}
+
+// ipAllowlistMiddleware refuses requests from clients outside networks.
+// An empty list lets everyone through. The client address honours the
+// engine's trusted proxies.
+func ipAllowlistMiddleware(networks []netip.Prefix) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(networks) == 0 {
+			c.Next()
+			return
+		}
+
+		addr, err := netip.ParseAddr(c.ClientIP())
+		if err != nil {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		addr = addr.Unmap()
+
+		for _, network := range networks {
+			if network.Contains(addr) {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatus(http.StatusForbidden)
+	}
+}
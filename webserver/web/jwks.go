@@ -0,0 +1,72 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// JWK is a public key in RFC 7517 form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// handleGetJWKS publishes the public keys that verify our tokens. Keys
+// stay listed until they are retired, so tokens signed before a rotation
+// can still be checked.
+func (s *HTTPServer) handleGetJWKS(c *gin.Context) {
+	type JWKS struct {
+		Keys []*JWK `json:"keys"`
+	}
+
+	jwks := JWKS{
+		Keys: make([]*JWK, 0, 4),
+	}
+
+	for _, key := range s.keyring.publicKeys() {
+		jwk := &JWK{
+			KeyID:     key.KID,
+			Algorithm: key.Algorithm,
+			Use:       "sig",
+		}
+
+		switch publicKey := key.verifyingKey.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		case *ecdsa.PublicKey:
+			ecdhKey, err := publicKey.ECDH()
+			if err != nil {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+
+			// Uncompressed point: 0x04 || X || Y
+			point := ecdhKey.Bytes()
+			size := (len(point) - 1) / 2
+
+			jwk.KeyType = "EC"
+			jwk.Curve = "P-256"
+			jwk.X = base64.RawURLEncoding.EncodeToString(point[1 : 1+size])
+			jwk.Y = base64.RawURLEncoding.EncodeToString(point[1+size:])
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	// Verifiers should refetch when they see a kid they don't know, so a
+	// short cache is fine
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, &jwks)
+}
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"time"
@@ -17,27 +18,47 @@ type JwtCustomClaims struct {
 	JwtCustomFields
 }
 
+// JwtCustomFields identifies the user by UUID. The other user fields are
+// a snapshot taken when the token was issued and may be out of date.
+// SessionID is the session the token was issued for.
 type JwtCustomFields struct {
 	Type      JwtTokenType `json:"token_type"`
+	UserUUID  uuid.UUID    `json:"user_uuid"`
+	SessionID uuid.UUID    `json:"sid,omitempty"`
 	Email     string       `json:"email"`
 	FirstName string       `json:"first_name"`
 	LastName  string       `json:"last_name"`
-	Password  string       `json:"password,omitempty"`
+
+	// RememberMe carries the login choice across the second factor step
+	RememberMe bool `json:"remember_me,omitempty"`
+
+	// AuthTime is when the user last proved who they are, as in OpenID
+	// Connect. Only access tokens carry it.
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+
+	// WebAuthnSession is the state of a passkey ceremony in progress
+	WebAuthnSession *webauthn.SessionData `json:"webauthn_session,omitempty"`
 }
 
 type JwtTokenType string
 
 const (
-	JwtTokenTypeAccess       JwtTokenType = "access"
-	JwtTokenTypeRefresh      JwtTokenType = "refresh"
-	JwtTokenTypeRegistration JwtTokenType = "registration"
+	JwtTokenTypeAccess  JwtTokenType = "access"
+	JwtTokenTypeRefresh JwtTokenType = "refresh"
+
+	// JwtTokenTypeMFA is held between the password and second factor
+	// steps of a login
+	JwtTokenTypeMFA JwtTokenType = "mfa"
+
+	// JwtTokenTypeWebAuthn is held between the start and finish of a
+	// passkey registration or login
+	JwtTokenTypeWebAuthn JwtTokenType = "webauthn"
 )
 
-func ParseToken(tokenStr string, secretKey []byte) (token *JwtToken, err error) {
-	jwtToken, err := jwt.ParseWithClaims(tokenStr, &JwtCustomClaims{}, func(t *jwt.Token) (any, error) {
-		return secretKey, nil
-	},
-		jwt.WithValidMethods([]string{"HS256"}),
+// ParseToken verifies tokenStr against the keys in keyring.
+func ParseToken(tokenStr string, keyring *Keyring) (token *JwtToken, err error) {
+	jwtToken, err := jwt.ParseWithClaims(tokenStr, &JwtCustomClaims{}, keyring.verificationKey,
+		jwt.WithValidMethods(signingAlgorithms),
 		jwt.WithExpirationRequired(),
 		jwt.WithIssuer(issuer),
 	)
@@ -50,6 +71,7 @@ func ParseToken(tokenStr string, secretKey []byte) (token *JwtToken, err error)
 	return
 }
 
+// MakeToken builds an unsigned token. Keyring.Sign picks the algorithm.
 func MakeToken(fields JwtCustomFields, validFor time.Duration) (token *JwtToken, err error) {
 	now := time.Now()
 
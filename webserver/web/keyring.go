@@ -0,0 +1,409 @@
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"lockbox-webserver/db"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// signingKeyRotationInterval is how long a key signs tokens before it
+	// is replaced.
+	signingKeyRotationInterval = 30 * 24 * time.Hour
+
+	// signingKeyReloadInterval is how often the keyring picks up keys made
+	// by other servers, and checks whether it's time to rotate.
+	signingKeyReloadInterval = time.Minute
+
+	// maxTokenLifetime is the longest any token is valid for. A superseded
+	// key is kept for verification until everything it signed has expired.
+	maxTokenLifetime = rememberMeRefreshTokenDuration
+)
+
+var NoSigningKeyError = errors.New("no signing key")
+
+// signingAlgorithms are the algorithms new keys can be made for. HS256
+// keys are shared secrets; the others publish their public half in the
+// JWKS so other services can verify tokens.
+var signingAlgorithms = []string{
+	jwt.SigningMethodHS256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+	jwt.SigningMethodES256.Alg(),
+}
+
+// Keyring holds the keys that sign and verify session tokens. The newest
+// key signs, and its kid goes in the token header so any key still in the
+// ring can verify.
+type Keyring struct {
+	dbPool *db.Pool
+
+	// algorithm is what new keys are made for
+	algorithm string
+
+	mu sync.RWMutex
+
+	// legacySecret verifies tokens signed before key IDs were introduced,
+	// which carry no kid header. Those tokens were all issued before the
+	// first key was made, so it is only accepted until legacyValidUntil,
+	// once they have all expired. legacyValidUntil is zero until the first
+	// key exists.
+	legacySecret     []byte
+	legacyValidUntil time.Time
+
+	keys   map[string]*keyringKey
+	active *keyringKey
+}
+
+// keyringKey is a signing key parsed ready for use.
+type keyringKey struct {
+	*db.SigningKey
+
+	method       jwt.SigningMethod
+	signingKey   any
+	verifyingKey any
+}
+
+func NewKeyring(dbPool *db.Pool, algorithm string, legacySecret []byte) (keyring *Keyring, err error) {
+	if !slices.Contains(signingAlgorithms, algorithm) {
+		err = fmt.Errorf("unsupported signing algorithm %q", algorithm)
+		return
+	}
+
+	keyring = &Keyring{
+		dbPool:       dbPool,
+		algorithm:    algorithm,
+		legacySecret: legacySecret,
+		keys:         make(map[string]*keyringKey),
+	}
+
+	return
+}
+
+// Reload replaces the keyring with the unretired keys in the database.
+func (k *Keyring) Reload(ctx context.Context) (err error) {
+	signingKeys, err := k.dbPool.ListSigningKeys(ctx, false)
+	if err != nil {
+		return
+	}
+
+	firstKeyCreatedAt, err := k.dbPool.SelectFirstSigningKeyCreatedAt(ctx)
+	if err != nil {
+		return
+	}
+
+	keys := make(map[string]*keyringKey, len(signingKeys))
+	var active *keyringKey
+	for i, signingKey := range signingKeys {
+		var key *keyringKey
+		if key, err = parseSigningKey(signingKey); err != nil {
+			return
+		}
+
+		keys[key.KID] = key
+		if i == 0 {
+			active = key
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = keys
+	k.active = active
+
+	if firstKeyCreatedAt != nil {
+		k.legacyValidUntil = firstKeyCreatedAt.Add(maxTokenLifetime)
+
+		// Nothing can be verified with it any more, so don't keep it
+		if time.Now().After(k.legacyValidUntil) {
+			k.legacySecret = nil
+		}
+	}
+
+	return
+}
+
+// parseSigningKey unpacks the stored key material. HS256 keys are stored
+// as the raw secret and the others as a PKCS #8 private key.
+func parseSigningKey(signingKey *db.SigningKey) (key *keyringKey, err error) {
+	key = &keyringKey{
+		SigningKey: signingKey,
+		method:     jwt.GetSigningMethod(signingKey.Algorithm),
+	}
+
+	switch signingKey.Algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		key.signingKey = signingKey.Secret
+		key.verifyingKey = signingKey.Secret
+		return
+	case jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodES256.Alg():
+	default:
+		err = fmt.Errorf("signing key %s has unsupported algorithm %q", signingKey.KID, signingKey.Algorithm)
+		return
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(signingKey.Secret)
+	if err != nil {
+		return
+	}
+
+	switch privateKey := privateKey.(type) {
+	case ed25519.PrivateKey:
+		key.signingKey = privateKey
+		key.verifyingKey = privateKey.Public()
+	case *ecdsa.PrivateKey:
+		key.signingKey = privateKey
+		key.verifyingKey = &privateKey.PublicKey
+	}
+
+	if key.method == nil || key.signingKey == nil {
+		err = fmt.Errorf("signing key %s does not match algorithm %q", signingKey.KID, signingKey.Algorithm)
+		return
+	}
+
+	return
+}
+
+// generateSigningKey makes fresh key material for algorithm, encoded the
+// way parseSigningKey expects.
+func generateSigningKey(algorithm string) (secret []byte, err error) {
+	var privateKey any
+
+	switch algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		return
+	case jwt.SigningMethodEdDSA.Alg():
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case jwt.SigningMethodES256.Alg():
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return
+	}
+
+	return x509.MarshalPKCS8PrivateKey(privateKey)
+}
+
+// Rotate makes a new key and starts signing with it.
+func (k *Keyring) Rotate(ctx context.Context) (err error) {
+	kid := make([]byte, 12)
+	if _, err = rand.Read(kid); err != nil {
+		return
+	}
+
+	secret, err := generateSigningKey(k.algorithm)
+	if err != nil {
+		return
+	}
+
+	if err = k.dbPool.InsertSigningKey(ctx, &db.SigningKey{
+		KID:       base64.RawURLEncoding.EncodeToString(kid),
+		Algorithm: k.algorithm,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		return
+	}
+
+	return k.Reload(ctx)
+}
+
+// ActiveKey is the key new tokens are signed with, or nil before the first
+// key has been made.
+func (k *Keyring) ActiveKey() *db.SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.active == nil {
+		return nil
+	}
+
+	return k.active.SigningKey
+}
+
+// newestKey is the newest key in the ring made for algorithm, or nil if
+// there is none.
+func (k *Keyring) newestKey(algorithm string) (newest *db.SigningKey) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.Algorithm == algorithm && (newest == nil || key.CreatedAt.After(newest.CreatedAt)) {
+			newest = key.SigningKey
+		}
+	}
+
+	return
+}
+
+// Sign signs token with the active key, switching it to the key's
+// algorithm.
+func (k *Keyring) Sign(token *JwtToken) (tokenStr string, err error) {
+	k.mu.RLock()
+	key := k.active
+	k.mu.RUnlock()
+
+	if key == nil {
+		err = NoSigningKeyError
+		return
+	}
+
+	token.Method = key.method
+	token.Header["alg"] = key.method.Alg()
+	token.Header["kid"] = key.KID
+
+	return token.SignedString(key.signingKey)
+}
+
+// verificationKey finds the key for a token being parsed.
+func (k *Keyring) verificationKey(t *jwt.Token) (any, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	kid, hasKID := t.Header["kid"].(string)
+	if !hasKID {
+		if len(k.legacySecret) == 0 || t.Method.Alg() != jwt.SigningMethodHS256.Alg() ||
+			(!k.legacyValidUntil.IsZero() && time.Now().After(k.legacyValidUntil)) {
+			return nil, errors.New("token has no key ID")
+		}
+
+		return k.legacySecret, nil
+	}
+
+	key, exists := k.keys[kid]
+	if !exists {
+		return nil, errors.New("unknown or retired signing key")
+	}
+
+	// Never let the token pick how its key is used
+	if t.Method.Alg() != key.Algorithm {
+		return nil, errors.New("signing method does not match key")
+	}
+
+	return key.verifyingKey, nil
+}
+
+// publicKeys lists the public halves of every asymmetric key in the ring.
+func (k *Keyring) publicKeys() (keys []*keyringKey) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.Algorithm != jwt.SigningMethodHS256.Alg() {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.SortFunc(keys, func(a, b *keyringKey) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return
+}
+
+// maintainSigningKeys keeps the keyring current: it picks up keys from
+// other servers, rotates the active key when it's due and retires keys
+// that can no longer have live tokens.
+func (s *HTTPServer) maintainSigningKeys(ctx context.Context) {
+	if err := s.keyring.Reload(ctx); err != nil {
+		log.Printf("signing keys: unable to reload: %v", err)
+		return
+	}
+
+	// Rotation is due when this server's algorithm has no current key, so a
+	// change of algorithm takes effect straight away. Servers that disagree
+	// about the algorithm while it's being changed each keep the other's
+	// newer key rather than taking turns to replace it.
+	if newest := s.keyring.newestKey(s.keyring.algorithm); newest == nil ||
+		time.Since(newest.CreatedAt) > signingKeyRotationInterval {
+		if err := s.keyring.Rotate(ctx); err != nil {
+			log.Printf("signing keys: unable to rotate: %v", err)
+			return
+		}
+	}
+
+	// Allow for other servers signing with a key until they next reload
+	supersededBefore := time.Now().Add(-maxTokenLifetime - signingKeyReloadInterval)
+
+	count, err := s.dbPool.RetireSigningKeys(ctx, supersededBefore)
+	if err != nil {
+		log.Printf("signing keys: unable to retire old keys: %v", err)
+		return
+	}
+
+	if count > 0 {
+		log.Printf("signing keys: retired %d keys", count)
+
+		if err = s.keyring.Reload(ctx); err != nil {
+			log.Printf("signing keys: unable to reload: %v", err)
+			return
+		}
+	}
+}
+
+func (s *HTTPServer) handleGetAdminKeysPage(c *gin.Context) {
+	keys, err := s.dbPool.ListSigningKeys(c, true)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type KeyRow struct {
+		*db.SigningKey
+		Active  bool
+		AgeDays int
+	}
+
+	type AdminKeysPageData struct {
+		AlertMsg         string
+		Keys             []*KeyRow
+		RotationInterval int
+		MaxTokenLifetime int
+	}
+
+	active := s.keyring.ActiveKey()
+
+	pageData := AdminKeysPageData{
+		Keys:             make([]*KeyRow, 0, len(keys)),
+		RotationInterval: int(signingKeyRotationInterval.Hours() / 24),
+		MaxTokenLifetime: int(maxTokenLifetime.Hours() / 24),
+	}
+	for _, key := range keys {
+		pageData.Keys = append(pageData.Keys, &KeyRow{
+			SigningKey: key,
+			Active:     active != nil && key.KID == active.KID,
+			AgeDays:    int(time.Since(key.CreatedAt).Hours() / 24),
+		})
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "admin_keys", &pageData)
+}
+
+// handleAdminRotateKey rotates the signing key ahead of schedule. Existing
+// tokens stay valid.
+func (s *HTTPServer) handleAdminRotateKey(c *gin.Context) {
+	if err := s.keyring.Rotate(c); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/admin/keys")
+}
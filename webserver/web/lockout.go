@@ -0,0 +1,107 @@
+package web
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"lockbox-webserver/db"
+	"net/http"
+	"time"
+)
+
+const (
+	// loginLockoutThreshold wrong passwords in a row lock an account for
+	// loginLockoutDuration
+	loginLockoutThreshold = 10
+	loginLockoutDuration  = 15 * time.Minute
+
+	// After loginDelayAfter wrong passwords, each attempt has to wait
+	// twice as long as the one before, up to maxLoginDelay
+	loginDelayAfter = 3
+	maxLoginDelay   = 30 * time.Second
+)
+
+// loginDelay is how long after their last wrong password a user with
+// failedLoginCount failures has to wait before trying again.
+func loginDelay(failedLoginCount int) time.Duration {
+	if failedLoginCount < loginDelayAfter {
+		return 0
+	}
+
+	delay := time.Second << (failedLoginCount - loginDelayAfter)
+	if delay > maxLoginDelay {
+		return maxLoginDelay
+	}
+
+	return delay
+}
+
+// loginRetryAfter is how long user must wait before their password is
+// checked again, or zero if they can try now.
+func loginRetryAfter(user *db.User) time.Duration {
+	if user.IsLocked() {
+		return time.Until(*user.LockedUntil)
+	}
+
+	if user.LastFailedLoginAt == nil {
+		return 0
+	}
+
+	return max(0, time.Until(user.LastFailedLoginAt.Add(loginDelay(user.FailedLoginCount))))
+}
+
+// recordFailedLogin counts a wrong password, and tells the user by email
+// if it locked their account.
+func (s *HTTPServer) recordFailedLogin(ctx context.Context, user *db.User) (err error) {
+	locked, err := s.dbPool.RecordFailedLogin(ctx, user.UUID, loginLockoutThreshold, loginLockoutDuration)
+	if err != nil || !locked {
+		return
+	}
+
+	msg, err := emailTemplateSet.Render("account_locked", &accountLockedEmailData{
+		FirstName:         user.FirstName,
+		LockedFor:         loginLockoutDuration.String(),
+		ForgotPasswordURL: s.hostname + "/app/forgotpassword",
+	})
+	if err != nil {
+		return
+	}
+	msg.To = []string{user.Email}
+
+	return s.enqueueMail(ctx, msg)
+}
+
+func (s *HTTPServer) loginRateLimitMiddleware(c *gin.Context) {
+	_, _, _, ok, err := s.loginLimiter.Take(c, c.ClientIP())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		mainTemplateSet.WriteTemplate(c,
+			http.StatusTooManyRequests,
+			"login",
+			NewAlertMsg("Too many login attempts. Please try again later"))
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// handleAdminUnlockUser lifts a lockout early.
+func (s *HTTPServer) handleAdminUnlockUser(c *gin.Context) {
+	userUUID, err := uuid.Parse(c.Param("userUUID"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if err = s.dbPool.ClearFailedLogins(c, userUUID); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeAdminUsersPage(c, http.StatusOK, "User unlocked")
+}
@@ -0,0 +1,214 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMailFrom = "No Reply <noreply@resend.reesenorr.is>"
+
+type MailMessage struct {
+	To      []string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Mailer delivers outgoing email.
+type Mailer interface {
+	SendMail(ctx context.Context, msg *MailMessage) error
+}
+
+// NewMailerFromEnv builds the Mailer named by MAILER, one of "resend"
+// (the default), "smtp", "file", "log" or "memory".
+func NewMailerFromEnv() (mailer Mailer, err error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	switch backend := os.Getenv("MAILER"); backend {
+	case "", "resend":
+		mailer = NewResendMailer(os.Getenv("RESEND_API_KEY"), from)
+	case "smtp":
+		mailer, err = NewSMTPMailer(
+			os.Getenv("SMTP_ADDR"),
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+			from,
+		)
+	case "file":
+		mailer, err = NewFileMailer(os.Getenv("MAIL_DIR"), from)
+	case "log":
+		mailer = NewLogMailer(from)
+	case "memory":
+		mailer = NewMemoryMailer()
+	default:
+		err = fmt.Errorf("unknown mailer %q", backend)
+	}
+
+	return
+}
+
+// LogMailer writes outgoing mail to the standard logger instead of
+// delivering it.
+type LogMailer struct {
+	from string
+}
+
+func NewLogMailer(from string) *LogMailer {
+	return &LogMailer{from: from}
+}
+
+func (m *LogMailer) SendMail(ctx context.Context, msg *MailMessage) (err error) {
+	body := msg.Text
+	if body == "" {
+		body = msg.HTML
+	}
+
+	log.Printf("mail from %s to %s: %s\n%s", m.from, strings.Join(msg.To, ", "), msg.Subject, body)
+
+	return
+}
+
+// MemoryMailer keeps every message it is asked to send, so tests can
+// inspect outgoing mail.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []*MailMessage
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) SendMail(ctx context.Context, msg *MailMessage) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+
+	return
+}
+
+// Messages returns every message sent so far, oldest first.
+func (m *MemoryMailer) Messages() []*MailMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*MailMessage(nil), m.messages...)
+}
+
+// formatMIMEMessage renders msg as an RFC 5322 message. If it has both an
+// HTML and a plain text body they are sent as multipart/alternative.
+func formatMIMEMessage(from string, msg *MailMessage) (buf bytes.Buffer, err error) {
+	if len(msg.To) == 0 {
+		err = errors.New("message has no recipients")
+		return
+	}
+
+	// Round-trip every address so nothing can smuggle extra headers in
+	recipients := make([]string, 0, len(msg.To))
+	for _, to := range msg.To {
+		var addr *mail.Address
+		if addr, err = mail.ParseAddress(to); err != nil {
+			return
+		}
+		recipients = append(recipients, addr.String())
+	}
+
+	messageID := make([]byte, 16)
+	if _, err = rand.Read(messageID); err != nil {
+		return
+	}
+
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at != -1 {
+		domain = strings.TrimSuffix(from[at+1:], ">")
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", from)
+	header.Set("To", strings.Join(recipients, ", "))
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", "<"+hex.EncodeToString(messageID)+"@"+domain+">")
+	header.Set("MIME-Version", "1.0")
+
+	parts := make([]textproto.MIMEHeader, 0, 2)
+	bodies := make([]string, 0, 2)
+	if msg.Text != "" {
+		parts = append(parts, textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+		bodies = append(bodies, msg.Text)
+	}
+	if msg.HTML != "" {
+		parts = append(parts, textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}})
+		bodies = append(bodies, msg.HTML)
+	}
+
+	var body bytes.Buffer
+	switch len(parts) {
+	case 0:
+		err = errors.New("message has no body")
+		return
+	case 1:
+		header.Set("Content-Type", parts[0].Get("Content-Type"))
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		if err = writeQuotedPrintable(&body, bodies[0]); err != nil {
+			return
+		}
+	default:
+		writer := multipart.NewWriter(&body)
+		header.Set("Content-Type", "multipart/alternative; boundary="+writer.Boundary())
+
+		for i, partHeader := range parts {
+			partHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+			part, partErr := writer.CreatePart(partHeader)
+			if partErr != nil {
+				err = partErr
+				return
+			}
+			if err = writeQuotedPrintable(part, bodies[i]); err != nil {
+				return
+			}
+		}
+
+		if err = writer.Close(); err != nil {
+			return
+		}
+	}
+
+	for _, key := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(key); value != "" {
+			buf.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+
+	return
+}
+
+func writeQuotedPrintable(w io.Writer, s string) (err error) {
+	qp := quotedprintable.NewWriter(w)
+	if _, err = qp.Write([]byte(s)); err != nil {
+		return
+	}
+
+	return qp.Close()
+}
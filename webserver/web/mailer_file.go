@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// FileMailer delivers mail into a local maildir, which is handy for
+// development without a mail provider. Any maildir-aware client, or
+// plain cat, can read the messages from dir/new.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir string, from string) (mailer *FileMailer, err error) {
+	if dir == "" {
+		err = errors.New("no mail directory configured")
+		return
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return
+		}
+	}
+
+	mailer = &FileMailer{
+		dir:  dir,
+		from: from,
+	}
+
+	return
+}
+
+func (m *FileMailer) SendMail(ctx context.Context, msg *MailMessage) (err error) {
+	body, err := formatMIMEMessage(m.from, msg)
+	if err != nil {
+		return
+	}
+
+	unique := make([]byte, 8)
+	if _, err = rand.Read(unique); err != nil {
+		return
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return
+	}
+
+	// Write into tmp and rename into new so readers never see a partial message
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "." + hex.EncodeToString(unique) + "." + hostname
+	tmpPath := filepath.Join(m.dir, "tmp", name)
+	if err = os.WriteFile(tmpPath, body.Bytes(), 0o600); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmpPath, filepath.Join(m.dir, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	return
+}
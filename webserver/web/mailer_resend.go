@@ -0,0 +1,33 @@
+package web
+
+import (
+	"context"
+	"github.com/resend/resend-go/v2"
+)
+
+// ResendMailer delivers mail through the Resend API.
+type ResendMailer struct {
+	client *resend.Client
+	from   string
+}
+
+func NewResendMailer(apiKey string, from string) *ResendMailer {
+	return &ResendMailer{
+		client: resend.NewClient(apiKey),
+		from:   from,
+	}
+}
+
+func (m *ResendMailer) SendMail(ctx context.Context, msg *MailMessage) (err error) {
+	if _, err = m.client.Emails.SendWithContext(ctx, &resend.SendEmailRequest{
+		From:    m.from,
+		To:      msg.To,
+		Subject: msg.Subject,
+		Html:    msg.HTML,
+		Text:    msg.Text,
+	}); err != nil {
+		return
+	}
+
+	return
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTPMailer delivers mail to an SMTP relay. STARTTLS is used whenever the
+// server offers it, and credentials are only sent over TLS.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPMailer(addr string, username string, password string, from string) (mailer *SMTPMailer, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+
+	mailer = &SMTPMailer{
+		addr: addr,
+		from: from,
+	}
+
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return
+}
+
+func (m *SMTPMailer) SendMail(ctx context.Context, msg *MailMessage) (err error) {
+	body, err := formatMIMEMessage(m.from, msg)
+	if err != nil {
+		return
+	}
+
+	sender, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return
+	}
+
+	recipients := make([]string, 0, len(msg.To))
+	for _, to := range msg.To {
+		var addr *mail.Address
+		if addr, err = mail.ParseAddress(to); err != nil {
+			return
+		}
+		recipients = append(recipients, addr.Address)
+	}
+
+	// net/smtp has no context support, so give up waiting on
+	// cancellation and let the send finish in the background
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- smtp.SendMail(m.addr, m.auth, sender.Address, recipients, body.Bytes())
+	}()
+
+	select {
+	case err = <-errChan:
+		return
+	case <-ctx.Done():
+		err = errors.Join(errors.New("smtp send abandoned"), ctx.Err())
+		return
+	}
+}
@@ -1,7 +1,12 @@
 package web
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"lockbox-webserver/db"
+	"log"
 	"net/http"
 	"time"
 )
@@ -15,18 +20,60 @@ func (s *HTTPServer) getAccessTokenFromContext(c *gin.Context) (token *JwtToken)
 	return val.(*JwtToken)
 }
 
+// selectCurrentUser loads the logged in user. The access token claims can
+// be stale, so the record is always read from the database.
+func (s *HTTPServer) selectCurrentUser(c *gin.Context) (user *db.User, err error) {
+	token := s.getAccessTokenFromContext(c)
+
+	return s.dbPool.SelectUserByUUID(c, token.CustomClaims().UserUUID)
+}
+
+// currentSessionID is the session the access token was issued for.
+func (s *HTTPServer) currentSessionID(c *gin.Context) uuid.UUID {
+	return s.getAccessTokenFromContext(c).CustomClaims().SessionID
+}
+
+// redirectToLogin clears the token cookies and sends the user back to the
+// login page.
+func (s *HTTPServer) redirectToLogin(c *gin.Context) {
+	s.clearCookie(c, "access_token")
+	s.clearCookie(c, "refresh_token")
+	c.Redirect(http.StatusTemporaryRedirect, "/app/login")
+	c.Abort()
+}
+
+// loadActiveSession loads a session, returning nil if it does not exist,
+// belongs to someone else or has been revoked or expired.
+func (s *HTTPServer) loadActiveSession(c *gin.Context, sessionID uuid.UUID, userUUID uuid.UUID) (session *db.Session, err error) {
+	session, err = s.dbPool.SelectSession(c, sessionID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = nil
+		}
+		session = nil
+		return
+	}
+
+	if session.UserUUID != userUUID || !session.IsActive() {
+		session = nil
+		return
+	}
+
+	return
+}
+
 func (s *HTTPServer) dashboardAuthMiddleware(c *gin.Context) {
-	accessTokenStr, err := c.Cookie("access_token")
+	accessTokenStr, err := s.cookie(c, "access_token")
 	accessTokenExists := err == nil
 
-	refreshTokenStr, err := c.Cookie("refresh_token")
+	refreshTokenStr, err := s.cookie(c, "refresh_token")
 	refreshTokenExists := err == nil
 
 	if !accessTokenExists && refreshTokenExists {
 		// Attempt to refresh session
-		refreshToken, err := ParseToken(refreshTokenStr, s.jwtSecretKey)
+		refreshToken, err := ParseToken(refreshTokenStr, s.keyring)
 		if err != nil {
-			c.Redirect(http.StatusTemporaryRedirect, "/login")
+			s.redirectToLogin(c)
 			return
 		}
 
@@ -35,55 +82,181 @@ func (s *HTTPServer) dashboardAuthMiddleware(c *gin.Context) {
 			return
 		}
 
-		newAccessTokenValidFor := 15 * time.Minute
-
 		claims := refreshToken.CustomClaims()
-		newAccessToken, err := MakeToken(JwtCustomFields{
-			Type:      JwtTokenTypeAccess,
-			Email:     claims.Email,
-			FirstName: claims.FirstName,
-			LastName:  claims.LastName,
-		}, newAccessTokenValidFor)
+
+		refreshTokenID, err := uuid.Parse(claims.ID)
+		if err != nil {
+			s.redirectToLogin(c)
+			return
+		}
+
+		// The new access token is built from the user record, so changes
+		// to the profile are picked up. Refresh tokens issued before a
+		// password reset are void. This is checked before the token is
+		// used up, so a refusal doesn't cost the client its session.
+		user, err := s.dbPool.SelectUserByUUID(c, claims.UserUUID)
+		if err != nil || user.TokenIssuedBeforeReset(claims.IssuedAt.Time) {
+			s.redirectToLogin(c)
+			return
+		}
+
+		// Every refresh token is single use. Its replacement keeps the
+		// original expiry, so a session can't be stretched out forever.
+		newRefreshToken, err := MakeToken(JwtCustomFields{
+			Type:      JwtTokenTypeRefresh,
+			UserUUID:  claims.UserUUID,
+			SessionID: claims.SessionID,
+		}, time.Until(claims.ExpiresAt.Time))
 		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		newAccessTokenStr, err := newAccessToken.SignedString(s.jwtSecretKey)
+		newRefreshTokenID, err := uuid.Parse(newRefreshToken.CustomClaims().ID)
 		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		c.SetCookie(
-			"access_token",
-			newAccessTokenStr,
-			int(newAccessTokenValidFor.Seconds()),
-			"", "", false, true,
-		)
+		session, newRefreshTokenID, err := s.dbPool.RotateRefreshToken(c,
+			refreshTokenID, newRefreshTokenID, refreshTokenReuseGrace,
+			c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			if errors.Is(err, db.RefreshTokenReusedError) {
+				log.Printf("auth: refresh token reused, revoked session %s of user %s", claims.SessionID, claims.UserUUID)
+			}
+
+			if errors.Is(err, db.RefreshTokenReusedError) ||
+				errors.Is(err, db.SessionInactiveError) ||
+				errors.Is(err, pgx.ErrNoRows) {
+				s.redirectToLogin(c)
+				return
+			}
 
-		accessTokenStr = newAccessTokenStr
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if session.UserUUID != claims.UserUUID {
+			s.redirectToLogin(c)
+			return
+		}
+
+		// Within the grace period the client gets the replacement that was
+		// already issued
+		newRefreshToken.CustomClaims().ID = newRefreshTokenID.String()
+
+		if err = s.issueAccessToken(c, user, session.ID, session.AuthenticatedAt); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if err = s.setRefreshTokenCookie(c, newRefreshToken); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Next()
+		return
 	}
 
 	// Parse access token
-	accessToken, err := ParseToken(accessTokenStr, s.jwtSecretKey)
+	accessToken, err := ParseToken(accessTokenStr, s.keyring)
 	if err != nil {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	if accessToken.CustomClaims().Type != JwtTokenTypeAccess {
+	claims := accessToken.CustomClaims()
+
+	if claims.Type != JwtTokenTypeAccess {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
+	// Tokens from before they carried the user and session need a fresh
+	// login
+	if claims.UserUUID == uuid.Nil || claims.SessionID == uuid.Nil {
+		s.redirectToLogin(c)
+		return
+	}
+
+	// Revoking a session also ends its access tokens
+	session, err := s.loadActiveSession(c, claims.SessionID, claims.UserUUID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if session == nil {
+		s.redirectToLogin(c)
+		return
+	}
+
 	c.Set("access_token", accessToken)
 
 	c.Next()
 }
 
+// adminAuthMiddleware must run after dashboardAuthMiddleware.
+func (s *HTTPServer) adminAuthMiddleware(c *gin.Context) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if user.Role != db.UserRoleAdmin {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	required, err := s.adminTOTPRequired(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if required && !user.TOTPEnabled() {
+		c.Redirect(http.StatusFound, "/app/dashboard/2fa")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
 func (s *HTTPServer) createAccountRateLimitMiddleware(c *gin.Context) {
-	_, _, _, ok, err := s.createAccountLimiter.Take(c, c.RemoteIP())
+	_, _, _, ok, err := s.createAccountLimiter.Take(c, c.ClientIP())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+
+	c.Next()
+}
+
+func (s *HTTPServer) deviceRateLimitMiddleware(c *gin.Context) {
+	_, _, _, ok, err := s.deviceLimiter.Take(c, c.ClientIP())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+
+	c.Next()
+}
+
+func (s *HTTPServer) passwordResetRateLimitMiddleware(c *gin.Context) {
+	_, _, _, ok, err := s.passwordResetLimiter.Take(c, c.ClientIP())
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -0,0 +1,146 @@
+package web
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"lockbox-webserver/db"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	outboxPollInterval = 5 * time.Second
+	outboxBatchSize    = 10
+
+	// outboxLease is how long a claimed message is hidden from other
+	// workers. It must outlast a single delivery attempt.
+	outboxLease = 2 * time.Minute
+
+	outboxBaseBackoff  = 30 * time.Second
+	outboxMaxBackoff   = time.Hour
+	outboxMaxAttempts  = 8
+	outboxSendTimeout  = time.Minute
+	outboxPageMaxItems = 100
+
+	// outboxRetention is how long sent and dead-lettered messages are kept.
+	// By then any link they hold has expired, so a dead message isn't worth
+	// resending.
+	outboxRetention = max(registrationValidFor, passwordResetValidFor, emailChangeValidFor)
+)
+
+// enqueueMail writes msg to the outbox. It is delivered in the background,
+// so a flaky mail provider never fails the request that sent it.
+func (s *HTTPServer) enqueueMail(ctx context.Context, msg *MailMessage) (err error) {
+	if _, err = s.dbPool.EnqueueEmail(ctx, msg.To, msg.Subject, msg.HTML, msg.Text); err != nil {
+		return
+	}
+
+	return
+}
+
+// outboxBackoff is the delay before retrying a message that has failed
+// attempts times, doubling from outboxBaseBackoff up to outboxMaxBackoff.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, outboxMaxBackoff)
+}
+
+// deliverOutbox sends every message in the outbox that is due.
+func (s *HTTPServer) deliverOutbox(ctx context.Context) {
+	for {
+		emails, err := s.dbPool.ClaimDueEmails(ctx, outboxBatchSize, outboxLease)
+		if err != nil {
+			log.Printf("outbox: unable to claim emails: %v", err)
+			return
+		}
+
+		for _, email := range emails {
+			s.deliverOutboxEmail(ctx, email)
+		}
+
+		// Keep going until the backlog is drained
+		if len(emails) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+func (s *HTTPServer) deliverOutboxEmail(ctx context.Context, email *db.OutboxEmail) {
+	sendCtx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+	defer cancel()
+
+	sendErr := s.mailer.SendMail(sendCtx, &MailMessage{
+		To:      email.To,
+		Subject: email.Subject,
+		HTML:    email.HTMLBody,
+		Text:    email.TextBody,
+	})
+
+	if sendErr == nil {
+		if err := s.dbPool.MarkEmailSent(ctx, email.UUID); err != nil {
+			log.Printf("outbox: unable to mark %s sent: %v", email.UUID, err)
+		}
+		return
+	}
+
+	attempts := email.Attempts + 1
+	dead := attempts >= outboxMaxAttempts
+	nextAttemptAt := time.Now().UTC().Add(outboxBackoff(attempts))
+
+	if err := s.dbPool.MarkEmailFailed(ctx, email.UUID, sendErr.Error(), nextAttemptAt, dead); err != nil {
+		log.Printf("outbox: unable to mark %s failed: %v", email.UUID, err)
+		return
+	}
+
+	if dead {
+		log.Printf("outbox: giving up on %s after %d attempts: %v", email.UUID, attempts, sendErr)
+	}
+}
+
+func (s *HTTPServer) handleGetAdminOutboxPage(c *gin.Context) {
+	emails, err := s.dbPool.ListUndeliveredEmails(c, outboxPageMaxItems)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type AdminOutboxPageData struct {
+		AlertMsg    string
+		Emails      []*db.OutboxEmail
+		MaxAttempts int
+	}
+
+	pageData := AdminOutboxPageData{
+		Emails:      emails,
+		MaxAttempts: outboxMaxAttempts,
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "admin_outbox", &pageData)
+}
+
+func (s *HTTPServer) handleAdminResendEmail(c *gin.Context) {
+	emailUUIDStr, exists := c.Params.Get("emailUUID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	emailUUID, err := uuid.Parse(emailUUIDStr)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if err = s.dbPool.RequeueEmail(c, emailUUID); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/admin/outbox")
+}
@@ -0,0 +1,418 @@
+package web
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"lockbox-webserver/db"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// passkeyCeremonyValidFor is how long the browser has between starting
+	// and finishing a passkey registration or login
+	passkeyCeremonyValidFor = 5 * time.Minute
+
+	maxPasskeyNameLength = 64
+)
+
+// newWebAuthn sets up passkeys for the site at hostname. Passkeys are
+// bound to its domain, so changing the hostname invalidates them.
+func newWebAuthn(hostname string) (w *webauthn.WebAuthn, err error) {
+	siteURL, err := url.Parse(hostname)
+	if err != nil {
+		return
+	}
+
+	// Passkeys are always discoverable, so no email is needed to log in,
+	// and always verify the user, so they can stand in for a password and
+	// second factor together
+	return webauthn.New(&webauthn.Config{
+		RPID:          siteURL.Hostname(),
+		RPDisplayName: "Lockbox",
+		RPOrigins:     []string{siteURL.Scheme + "://" + siteURL.Host},
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		},
+	})
+}
+
+// passkeyStore is where users' passkeys are kept. It is the database pool
+// other than in tests.
+type passkeyStore interface {
+	SelectUserByUUID(ctx context.Context, userUUID uuid.UUID) (*db.User, error)
+	ListUserPasskeys(ctx context.Context, userUUID uuid.UUID) ([]*db.Passkey, error)
+	InsertPasskey(ctx context.Context, passkey *db.Passkey) error
+	UpdatePasskeyCredential(ctx context.Context, id []byte, credential []byte) error
+	DeletePasskey(ctx context.Context, id []byte, userUUID uuid.UUID) error
+	UsePasskeyCeremony(ctx context.Context, id uuid.UUID, expiresAt time.Time) (bool, error)
+	EnqueueEmail(ctx context.Context, to []string, subject string, htmlBody string, textBody string) (*db.OutboxEmail, error)
+}
+
+// passkeyUser is a user along with their passkeys, as the WebAuthn
+// library wants them. The user handle is the user's UUID.
+type passkeyUser struct {
+	*db.User
+
+	passkeys    []*db.Passkey
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return u.UUID[:]
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.Email
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.FirstName + " " + u.LastName
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+// loadPasskeyUser loads user's passkeys.
+func (s *HTTPServer) loadPasskeyUser(ctx context.Context, user *db.User) (pkUser *passkeyUser, err error) {
+	passkeys, err := s.passkeys.ListUserPasskeys(ctx, user.UUID)
+	if err != nil {
+		return
+	}
+
+	pkUser = &passkeyUser{
+		User:        user,
+		passkeys:    passkeys,
+		credentials: make([]webauthn.Credential, len(passkeys)),
+	}
+	for i, passkey := range passkeys {
+		if err = json.Unmarshal(passkey.Credential, &pkUser.credentials[i]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// selectPasskeyOwner loads the logged in user from the passkey store.
+func (s *HTTPServer) selectPasskeyOwner(c *gin.Context) (user *db.User, err error) {
+	return s.passkeys.SelectUserByUUID(c, s.getAccessTokenFromContext(c).CustomClaims().UserUUID)
+}
+
+// setPasskeyCeremonyCookie remembers the state of a ceremony until the
+// browser finishes it. userUUID is only set for registrations.
+func (s *HTTPServer) setPasskeyCeremonyCookie(c *gin.Context, userUUID uuid.UUID, session *webauthn.SessionData) (err error) {
+	ceremonyToken, err := MakeToken(JwtCustomFields{
+		Type:            JwtTokenTypeWebAuthn,
+		UserUUID:        userUUID,
+		WebAuthnSession: session,
+	}, passkeyCeremonyValidFor)
+	if err != nil {
+		return
+	}
+	ceremonyTokenStr, err := s.keyring.Sign(ceremonyToken)
+	if err != nil {
+		return
+	}
+
+	s.setCookie(c, "webauthn_session", ceremonyTokenStr, int(passkeyCeremonyValidFor.Seconds()))
+
+	return
+}
+
+// takePasskeyCeremony reads and clears the ceremony cookie. Each ceremony
+// is also marked as used, so its challenge can only be answered once even
+// if the cookie is sent again.
+func (s *HTTPServer) takePasskeyCeremony(c *gin.Context) (claims *JwtCustomClaims, err error) {
+	ceremonyTokenStr, err := s.cookie(c, "webauthn_session")
+	if err != nil {
+		return
+	}
+
+	s.clearCookie(c, "webauthn_session")
+
+	ceremonyToken, err := ParseToken(ceremonyTokenStr, s.keyring)
+	if err != nil {
+		return
+	}
+
+	claims = ceremonyToken.CustomClaims()
+	if claims.Type != JwtTokenTypeWebAuthn || claims.WebAuthnSession == nil {
+		err = errors.New("not a passkey ceremony token")
+		return
+	}
+
+	ceremonyID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return
+	}
+
+	ok, err := s.passkeys.UsePasskeyCeremony(c, ceremonyID, claims.ExpiresAt.Time)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = errors.New("passkey ceremony already used")
+		return
+	}
+
+	return
+}
+
+func (s *HTTPServer) handleBeginPasskeyLogin(c *gin.Context) {
+	assertion, session, err := s.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.setPasskeyCeremonyCookie(c, uuid.Nil, session); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, assertion)
+}
+
+func (s *HTTPServer) handleFinishPasskeyLogin(c *gin.Context) {
+	user := s.verifyPasskeyLogin(c)
+	if user == nil {
+		return
+	}
+
+	if err := s.startSession(c, user, false); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect": "/app/dashboard"})
+}
+
+// verifyPasskeyLogin checks the browser's answer to a login ceremony and
+// returns the user whose passkey signed it. If the login is refused the
+// request is aborted and nil is returned.
+func (s *HTTPServer) verifyPasskeyLogin(c *gin.Context) (user *db.User) {
+	ceremony, err := s.takePasskeyCeremony(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	// The passkey names its user by their handle
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userUUID, err := uuid.FromBytes(userHandle)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err := s.passkeys.SelectUserByUUID(c, userUUID)
+		if err != nil {
+			return nil, err
+		}
+
+		return s.loadPasskeyUser(c, user)
+	}
+
+	webauthnUser, credential, err := s.webauthn.FinishPasskeyLogin(findUser, *ceremony.WebAuthnSession, c.Request)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	// A counter that went backwards means the key may have been copied
+	if credential.Authenticator.CloneWarning {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.passkeys.UpdatePasskeyCredential(c, credential.ID, credentialJSON); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	return webauthnUser.(*passkeyUser).User
+}
+
+func (s *HTTPServer) handleGetPasskeysPage(c *gin.Context) {
+	s.writePasskeysPage(c, http.StatusOK, "")
+}
+
+func (s *HTTPServer) writePasskeysPage(c *gin.Context, status int, alertMsg string) {
+	user, err := s.selectPasskeyOwner(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	passkeys, err := s.passkeys.ListUserPasskeys(c, user.UUID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type PasskeyRow struct {
+		*db.Passkey
+		EncodedID string
+	}
+
+	type PasskeysPageData struct {
+		AlertMsg string
+		Passkeys []*PasskeyRow
+	}
+
+	pageData := PasskeysPageData{
+		AlertMsg: alertMsg,
+		Passkeys: make([]*PasskeyRow, 0, len(passkeys)),
+	}
+	for _, passkey := range passkeys {
+		pageData.Passkeys = append(pageData.Passkeys, &PasskeyRow{
+			Passkey:   passkey,
+			EncodedID: base64.RawURLEncoding.EncodeToString(passkey.ID),
+		})
+	}
+
+	mainTemplateSet.WriteTemplate(c, status, "passkeys", &pageData)
+}
+
+func (s *HTTPServer) handleBeginPasskeyRegistration(c *gin.Context) {
+	user, err := s.selectPasskeyOwner(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	pkUser, err := s.loadPasskeyUser(c, user)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Stop the same authenticator being registered twice
+	creation, session, err := s.webauthn.BeginRegistration(pkUser,
+		webauthn.WithExclusions(webauthn.Credentials(pkUser.credentials).CredentialDescriptors()))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.setPasskeyCeremonyCookie(c, user.UUID, session); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, creation)
+}
+
+func (s *HTTPServer) handleFinishPasskeyRegistration(c *gin.Context) {
+	name := c.Query("name")
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > maxPasskeyNameLength {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.selectPasskeyOwner(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ceremony, err := s.takePasskeyCeremony(c)
+	if err != nil || ceremony.UserUUID != user.UUID {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	pkUser, err := s.loadPasskeyUser(c, user)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := s.webauthn.FinishRegistration(pkUser, *ceremony.WebAuthnSession, c.Request)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.passkeys.InsertPasskey(c, &db.Passkey{
+		ID:         credential.ID,
+		UserUUID:   user.UUID,
+		Name:       name,
+		Credential: credentialJSON,
+		CreatedAt:  time.Now().UTC(),
+	}); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// The passkey is already saved, so a lost email shouldn't fail the request
+	if err = s.notifyPasskeyAdded(c, user, name); err != nil {
+		log.Printf("passkeys: unable to notify %s of a new passkey: %v", user.UUID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect": "/app/dashboard/passkeys"})
+}
+
+// notifyPasskeyAdded emails user about a passkey added to their account,
+// so they find out if it wasn't them.
+func (s *HTTPServer) notifyPasskeyAdded(ctx context.Context, user *db.User, passkeyName string) (err error) {
+	msg, err := emailTemplateSet.Render("passkey_added", &passkeyAddedEmailData{
+		FirstName:   user.FirstName,
+		PasskeyName: passkeyName,
+		PasskeysURL: s.hostname + "/app/dashboard/passkeys",
+	})
+	if err != nil {
+		return
+	}
+
+	_, err = s.passkeys.EnqueueEmail(ctx, []string{user.Email}, msg.Subject, msg.HTML, msg.Text)
+
+	return
+}
+
+func (s *HTTPServer) handleDeletePasskey(c *gin.Context) {
+	passkeyID, err := base64.RawURLEncoding.DecodeString(c.Param("passkeyID"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.selectPasskeyOwner(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.passkeys.DeletePasskey(c, passkeyID, user.UUID); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writePasskeysPage(c, http.StatusOK, "Passkey removed")
+}
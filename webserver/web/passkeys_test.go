@@ -0,0 +1,492 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"lockbox-webserver/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testSiteURL = "http://localhost:8000"
+
+// memoryPasskeyStore keeps passkeys in memory in place of the database.
+type memoryPasskeyStore struct {
+	users          map[uuid.UUID]*db.User
+	passkeys       []*db.Passkey
+	usedCeremonies map[uuid.UUID]bool
+	emails         []*db.OutboxEmail
+}
+
+func (m *memoryPasskeyStore) SelectUserByUUID(ctx context.Context, userUUID uuid.UUID) (*db.User, error) {
+	user, exists := m.users[userUUID]
+	if !exists {
+		return nil, pgx.ErrNoRows
+	}
+
+	return user, nil
+}
+
+func (m *memoryPasskeyStore) ListUserPasskeys(ctx context.Context, userUUID uuid.UUID) (passkeys []*db.Passkey, err error) {
+	for _, passkey := range m.passkeys {
+		if passkey.UserUUID == userUUID {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+
+	return
+}
+
+func (m *memoryPasskeyStore) InsertPasskey(ctx context.Context, passkey *db.Passkey) error {
+	m.passkeys = append(m.passkeys, passkey)
+
+	return nil
+}
+
+func (m *memoryPasskeyStore) UpdatePasskeyCredential(ctx context.Context, id []byte, credential []byte) error {
+	for _, passkey := range m.passkeys {
+		if bytes.Equal(passkey.ID, id) {
+			passkey.Credential = credential
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryPasskeyStore) DeletePasskey(ctx context.Context, id []byte, userUUID uuid.UUID) error {
+	for i, passkey := range m.passkeys {
+		if bytes.Equal(passkey.ID, id) && passkey.UserUUID == userUUID {
+			m.passkeys = append(m.passkeys[:i], m.passkeys[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryPasskeyStore) UsePasskeyCeremony(ctx context.Context, id uuid.UUID, expiresAt time.Time) (bool, error) {
+	if m.usedCeremonies[id] {
+		return false, nil
+	}
+	m.usedCeremonies[id] = true
+
+	return true, nil
+}
+
+func (m *memoryPasskeyStore) EnqueueEmail(ctx context.Context, to []string, subject string, htmlBody string, textBody string) (*db.OutboxEmail, error) {
+	email := &db.OutboxEmail{
+		UUID:     uuid.New(),
+		To:       to,
+		Subject:  subject,
+		HTMLBody: htmlBody,
+		TextBody: textBody,
+	}
+	m.emails = append(m.emails, email)
+
+	return email, nil
+}
+
+// softAuthenticator stands in for a browser and a passkey, answering
+// ceremonies with an in-memory P-256 key.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+
+	// origin is the site the browser says the ceremony ran on
+	origin string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 16)
+	if _, err = rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{
+		key:          key,
+		credentialID: credentialID,
+		origin:       testSiteURL,
+	}
+}
+
+// ceremonyOptions is the part of the options from a begin handler the
+// authenticator needs.
+type ceremonyOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+func parseCeremonyOptions(t *testing.T, optionsJSON []byte) (options ceremonyOptions) {
+	if err := json.Unmarshal(optionsJSON, &options); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func (a *softAuthenticator) clientDataJSON(t *testing.T, ceremonyType string, challenge string) []byte {
+	clientData, err := json.Marshal(map[string]any{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clientData
+}
+
+// authenticatorData is signed over by the authenticator. flags always has
+// user presence and verification set.
+func (a *softAuthenticator) authenticatorData(flags byte, attestedCredential []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+
+	var authData bytes.Buffer
+	authData.Write(rpIDHash[:])
+	authData.WriteByte(flags | 0x05)
+	binary.Write(&authData, binary.BigEndian, a.signCount)
+	authData.Write(attestedCredential)
+
+	return authData.Bytes()
+}
+
+// register answers the options from handleBeginPasskeyRegistration.
+func (a *softAuthenticator) register(t *testing.T, optionsJSON []byte) []byte {
+	options := parseCeremonyOptions(t, optionsJSON)
+
+	userHandle, err := base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = userHandle
+
+	publicKey, err := cbor.Marshal(map[int]any{
+		1:  2,  // EC2 key
+		3:  -7, // ES256
+		-1: 1,  // P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var attestedCredential bytes.Buffer
+	attestedCredential.Write(make([]byte, 16))
+	binary.Write(&attestedCredential, binary.BigEndian, uint16(len(a.credentialID)))
+	attestedCredential.Write(a.credentialID)
+	attestedCredential.Write(publicKey)
+
+	attestationObject, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(0x40, attestedCredential.Bytes()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credentialJSON(t, map[string]any{
+		"clientDataJSON":    a.clientDataJSON(t, "webauthn.create", options.PublicKey.Challenge),
+		"attestationObject": attestationObject,
+	})
+}
+
+// login answers the options from handleBeginPasskeyLogin, counting up the
+// signature counter first as a real authenticator would.
+func (a *softAuthenticator) login(t *testing.T, optionsJSON []byte) []byte {
+	options := parseCeremonyOptions(t, optionsJSON)
+
+	a.signCount++
+
+	authData := a.authenticatorData(0x00, nil)
+	clientData := a.clientDataJSON(t, "webauthn.get", options.PublicKey.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credentialJSON(t, map[string]any{
+		"clientDataJSON":    clientData,
+		"authenticatorData": authData,
+		"signature":         signature,
+		"userHandle":        a.userHandle,
+	})
+}
+
+// credentialJSON encodes a credential the way PublicKeyCredential.toJSON
+// does in the browser.
+func (a *softAuthenticator) credentialJSON(t *testing.T, response map[string]any) []byte {
+	encodedResponse := make(map[string]string, len(response))
+	for name, value := range response {
+		encodedResponse[name] = base64.RawURLEncoding.EncodeToString(value.([]byte))
+	}
+
+	credential, err := json.Marshal(map[string]any{
+		"id":       base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":     "public-key",
+		"response": encodedResponse,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return credential
+}
+
+// newPasskeyTestServer runs the passkey handlers against an in-memory
+// store holding one user. Registration routes act as that user, and the
+// login finish route answers with the UUID of whoever logged in.
+func newPasskeyTestServer(t *testing.T) (engine *gin.Engine, store *memoryPasskeyStore, user *db.User) {
+	webAuthn, err := newWebAuthn(testSiteURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("passkey test signing key")
+	keyring := &Keyring{
+		algorithm: "HS256",
+		keys:      make(map[string]*keyringKey),
+	}
+	keyring.active = &keyringKey{
+		SigningKey:   &db.SigningKey{KID: "test", Algorithm: "HS256"},
+		method:       jwt.SigningMethodHS256,
+		signingKey:   secret,
+		verifyingKey: secret,
+	}
+	keyring.keys["test"] = keyring.active
+
+	user = &db.User{
+		UUID:      uuid.New(),
+		Email:     "owner@example.com",
+		FirstName: "Lock",
+		LastName:  "Owner",
+	}
+
+	store = &memoryPasskeyStore{
+		users:          map[uuid.UUID]*db.User{user.UUID: user},
+		usedCeremonies: make(map[uuid.UUID]bool),
+	}
+
+	s := &HTTPServer{
+		hostname: testSiteURL,
+		keyring:  keyring,
+		webauthn: webAuthn,
+		passkeys: store,
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine = gin.New()
+
+	engine.POST("/login/begin", s.handleBeginPasskeyLogin)
+	engine.POST("/login/finish", func(c *gin.Context) {
+		if user := s.verifyPasskeyLogin(c); user != nil {
+			c.JSON(http.StatusOK, gin.H{"user_uuid": user.UUID})
+		}
+	})
+
+	loggedIn := engine.Group("", func(c *gin.Context) {
+		accessToken, err := MakeToken(JwtCustomFields{
+			Type:     JwtTokenTypeAccess,
+			UserUUID: user.UUID,
+		}, accessTokenDuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Set("access_token", accessToken)
+	})
+	loggedIn.POST("/register/begin", s.handleBeginPasskeyRegistration)
+	loggedIn.POST("/register/finish", s.handleFinishPasskeyRegistration)
+
+	return
+}
+
+// post sends body to path along with cookies, as the passkey scripts do.
+func post(engine *gin.Engine, path string, body []byte, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	return w
+}
+
+func registerPasskey(t *testing.T, engine *gin.Engine, authenticator *softAuthenticator) *httptest.ResponseRecorder {
+	begin := post(engine, "/register/begin", nil, nil)
+	if begin.Code != http.StatusOK {
+		t.Fatalf("beginning registration: got status %d", begin.Code)
+	}
+
+	return post(engine, "/register/finish?name=Test+key",
+		authenticator.register(t, begin.Body.Bytes()),
+		begin.Result().Cookies())
+}
+
+func beginLogin(t *testing.T, engine *gin.Engine) *httptest.ResponseRecorder {
+	begin := post(engine, "/login/begin", nil, nil)
+	if begin.Code != http.StatusOK {
+		t.Fatalf("beginning login: got status %d", begin.Code)
+	}
+
+	return begin
+}
+
+func storedSignCount(t *testing.T, passkey *db.Passkey) uint32 {
+	var credential webauthn.Credential
+	if err := json.Unmarshal(passkey.Credential, &credential); err != nil {
+		t.Fatal(err)
+	}
+
+	return credential.Authenticator.SignCount
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	engine, store, user := newPasskeyTestServer(t)
+	authenticator := newSoftAuthenticator(t)
+
+	if w := registerPasskey(t, engine, authenticator); w.Code != http.StatusOK {
+		t.Fatalf("finishing registration: got status %d", w.Code)
+	}
+
+	if len(store.passkeys) != 1 {
+		t.Fatalf("got %d stored passkeys, want 1", len(store.passkeys))
+	}
+	passkey := store.passkeys[0]
+	if passkey.UserUUID != user.UUID || passkey.Name != "Test key" || !bytes.Equal(passkey.ID, authenticator.credentialID) {
+		t.Fatalf("stored passkey %+v doesn't match the registration", passkey)
+	}
+
+	if len(store.emails) != 1 || len(store.emails[0].To) != 1 || store.emails[0].To[0] != user.Email {
+		t.Fatalf("got emails %+v, want one to %s about the new passkey", store.emails, user.Email)
+	}
+
+	begin := beginLogin(t, engine)
+	finish := post(engine, "/login/finish", authenticator.login(t, begin.Body.Bytes()), begin.Result().Cookies())
+	if finish.Code != http.StatusOK {
+		t.Fatalf("finishing login: got status %d", finish.Code)
+	}
+
+	var body struct {
+		UserUUID uuid.UUID `json:"user_uuid"`
+	}
+	if err := json.Unmarshal(finish.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.UserUUID != user.UUID {
+		t.Fatalf("logged in as %s, want %s", body.UserUUID, user.UUID)
+	}
+
+	if signCount := storedSignCount(t, passkey); signCount != authenticator.signCount {
+		t.Fatalf("stored sign count is %d, want %d", signCount, authenticator.signCount)
+	}
+}
+
+func TestPasskeyCeremonyReplay(t *testing.T) {
+	engine, _, _ := newPasskeyTestServer(t)
+	authenticator := newSoftAuthenticator(t)
+
+	if w := registerPasskey(t, engine, authenticator); w.Code != http.StatusOK {
+		t.Fatalf("finishing registration: got status %d", w.Code)
+	}
+
+	begin := beginLogin(t, engine)
+	if w := post(engine, "/login/finish", authenticator.login(t, begin.Body.Bytes()), begin.Result().Cookies()); w.Code != http.StatusOK {
+		t.Fatalf("finishing login: got status %d", w.Code)
+	}
+
+	// A fresh signature over the same challenge, so only the ceremony
+	// having been used already can stop it
+	if w := post(engine, "/login/finish", authenticator.login(t, begin.Body.Bytes()), begin.Result().Cookies()); w.Code != http.StatusUnauthorized {
+		t.Fatalf("replaying login ceremony: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPasskeyWrongOrigin(t *testing.T) {
+	engine, store, _ := newPasskeyTestServer(t)
+
+	phished := newSoftAuthenticator(t)
+	phished.origin = "https://lockbox.example.net"
+
+	if w := registerPasskey(t, engine, phished); w.Code != http.StatusBadRequest {
+		t.Fatalf("registering from another origin: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if len(store.passkeys) != 0 {
+		t.Fatalf("got %d stored passkeys, want 0", len(store.passkeys))
+	}
+
+	authenticator := newSoftAuthenticator(t)
+	if w := registerPasskey(t, engine, authenticator); w.Code != http.StatusOK {
+		t.Fatalf("finishing registration: got status %d", w.Code)
+	}
+
+	authenticator.origin = phished.origin
+
+	begin := beginLogin(t, engine)
+	if w := post(engine, "/login/finish", authenticator.login(t, begin.Body.Bytes()), begin.Result().Cookies()); w.Code != http.StatusUnauthorized {
+		t.Fatalf("logging in from another origin: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPasskeyCounterWentBackwards(t *testing.T) {
+	engine, store, _ := newPasskeyTestServer(t)
+	authenticator := newSoftAuthenticator(t)
+
+	if w := registerPasskey(t, engine, authenticator); w.Code != http.StatusOK {
+		t.Fatalf("finishing registration: got status %d", w.Code)
+	}
+
+	authenticator.signCount = 9
+
+	begin := beginLogin(t, engine)
+	if w := post(engine, "/login/finish", authenticator.login(t, begin.Body.Bytes()), begin.Result().Cookies()); w.Code != http.StatusOK {
+		t.Fatalf("finishing login: got status %d", w.Code)
+	}
+
+	// A copy of the key that has been used less than the original
+	authenticator.signCount = 3
+
+	begin = beginLogin(t, engine)
+	if w := post(engine, "/login/finish", authenticator.login(t, begin.Body.Bytes()), begin.Result().Cookies()); w.Code != http.StatusUnauthorized {
+		t.Fatalf("logging in with a cloned key: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if signCount := storedSignCount(t, store.passkeys[0]); signCount != 10 {
+		t.Fatalf("stored sign count is %d, want 10", signCount)
+	}
+}
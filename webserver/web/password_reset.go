@@ -0,0 +1,146 @@
+package web
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"time"
+)
+
+const passwordResetValidFor = time.Hour
+
+func (s *HTTPServer) handleGetForgotPasswordPage(c *gin.Context) {
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "forgot_password", nil)
+}
+
+func (s *HTTPServer) handleForgotPasswordSubmit(c *gin.Context) {
+	email := c.PostForm("email")
+	if email == "" {
+		mainTemplateSet.WriteTemplate(c,
+			http.StatusBadRequest,
+			"forgot_password",
+			NewAlertMsg("Please enter your email"))
+		return
+	}
+
+	// Respond the same way whether or not the account exists, so this page
+	// can't be used to find out who has one
+	sentMsg := NewAlertMsg("If that email has an account, a password reset link has been sent to it")
+
+	user, err := s.dbPool.SelectUserByEmail(c, email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			mainTemplateSet.WriteTemplate(c, http.StatusOK, "login", sentMsg)
+			return
+		}
+
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resetToken, resetTokenHash, err := newOpaqueToken()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.InsertPasswordReset(c, resetTokenHash, user.UUID, time.Now().UTC().Add(passwordResetValidFor)); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	msg, err := emailTemplateSet.Render("password_reset", &passwordResetEmailData{
+		FirstName: user.FirstName,
+		ResetURL:  s.hostname + "/app/resetpassword/" + resetToken,
+		ValidFor:  passwordResetValidFor.String(),
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	msg.To = []string{user.Email}
+
+	if err = s.enqueueMail(c, msg); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "login", sentMsg)
+}
+
+func (s *HTTPServer) handleGetResetPasswordPage(c *gin.Context) {
+	token, exists := c.Params.Get("token")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	valid, err := s.dbPool.PasswordResetExists(c, hashOpaqueToken(token))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		mainTemplateSet.WriteTemplate(c,
+			http.StatusNotFound,
+			"forgot_password",
+			NewAlertMsg("This reset link is invalid or has expired. Please request a new one"))
+		return
+	}
+
+	type ResetPasswordPageData struct {
+		AlertMsg string
+		Token    string
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "reset_password", &ResetPasswordPageData{
+		Token: token,
+	})
+}
+
+func (s *HTTPServer) handleResetPasswordSubmit(c *gin.Context) {
+	token, exists := c.Params.Get("token")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	password := c.PostForm("password")
+	if password == "" || password != c.PostForm("confirm_password") {
+		type ResetPasswordPageData struct {
+			AlertMsg string
+			Token    string
+		}
+
+		mainTemplateSet.WriteTemplate(c, http.StatusBadRequest, "reset_password", &ResetPasswordPageData{
+			AlertMsg: "Passwords are empty or do not match",
+			Token:    token,
+		})
+		return
+	}
+
+	if _, err := s.dbPool.ResetPassword(c, hashOpaqueToken(token), password); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			mainTemplateSet.WriteTemplate(c,
+				http.StatusNotFound,
+				"forgot_password",
+				NewAlertMsg("This reset link is invalid or has expired. Please request a new one"))
+			return
+		}
+
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Make sure this browser doesn't hold on to a session that was just
+	// invalidated
+	s.clearCookie(c, "access_token")
+	s.clearCookie(c, "refresh_token")
+
+	mainTemplateSet.WriteTemplate(c,
+		http.StatusOK,
+		"login",
+		NewAlertMsg("Your password has been reset. Please log in"))
+}
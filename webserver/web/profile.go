@@ -0,0 +1,277 @@
+package web
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+	"lockbox-webserver/db"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const emailChangeValidFor = 24 * time.Hour
+
+func (s *HTTPServer) handleGetProfilePage(c *gin.Context) {
+	s.writeProfilePage(c, http.StatusOK, "")
+}
+
+func (s *HTTPServer) writeProfilePage(c *gin.Context, status int, alertMsg string) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type ProfilePageData struct {
+		AlertMsg string
+		User     *db.User
+	}
+
+	pageData := ProfilePageData{
+		AlertMsg: alertMsg,
+		User:     user,
+	}
+
+	mainTemplateSet.WriteTemplate(c, status, "profile", &pageData)
+}
+
+func (s *HTTPServer) handleUpdateProfileName(c *gin.Context) {
+	firstName := strings.TrimSpace(c.PostForm("first_name"))
+	lastName := strings.TrimSpace(c.PostForm("last_name"))
+	if firstName == "" || lastName == "" {
+		s.writeProfilePage(c, http.StatusBadRequest, "One or more fields are empty")
+		return
+	}
+
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.UpdateUserName(c, user.UUID, firstName, lastName); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Swap the access token so it carries the new name straight away
+	user.FirstName = firstName
+	user.LastName = lastName
+	if err = s.issueAccessToken(c, user, s.currentSessionID(c), s.currentAuthTime(c)); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeProfilePage(c, http.StatusOK, "Name updated")
+}
+
+func (s *HTTPServer) handleUpdateProfilePassword(c *gin.Context) {
+	currentPassword := c.PostForm("current_password")
+	newPassword := c.PostForm("new_password")
+	if newPassword == "" || newPassword != c.PostForm("confirm_password") {
+		s.writeProfilePage(c, http.StatusBadRequest, "New passwords are empty or do not match")
+		return
+	}
+
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword)) != nil {
+		s.writeProfilePage(c, http.StatusUnauthorized, "Current password is incorrect")
+		return
+	}
+
+	if err = s.dbPool.UpdateUserPassword(c, user.UUID, newPassword); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Anyone else logged in with the old password is logged out
+	if err = s.dbPool.RevokeUserSessions(c, user.UUID, s.currentSessionID(c)); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeProfilePage(c, http.StatusOK, "Password updated. Your other sessions have been logged out")
+}
+
+// handleUpdateProfileEmail sends a confirmation link to the new address.
+// The email only changes once that link is followed.
+func (s *HTTPServer) handleUpdateProfileEmail(c *gin.Context) {
+	newEmail := strings.TrimSpace(c.PostForm("email"))
+	if addr, err := mail.ParseAddress(newEmail); err != nil || addr.Address != newEmail {
+		s.writeProfilePage(c, http.StatusBadRequest, "Invalid email")
+		return
+	}
+
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(c.PostForm("password"))) != nil {
+		s.writeProfilePage(c, http.StatusUnauthorized, "Password is incorrect")
+		return
+	}
+
+	if _, err = s.dbPool.SelectUserByEmail(c, newEmail); err == nil {
+		s.writeProfilePage(c, http.StatusBadRequest, "Email already in use")
+		return
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	changeToken, changeTokenHash, err := newOpaqueToken()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.InsertEmailChange(c, changeTokenHash, user.UUID, newEmail, time.Now().UTC().Add(emailChangeValidFor)); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	msg, err := emailTemplateSet.Render("confirm_email_change", &confirmEmailChangeData{
+		FirstName:       user.FirstName,
+		NewEmail:        newEmail,
+		ConfirmationURL: s.hostname + "/app/confirmemailchange/" + changeToken,
+	})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	msg.To = []string{newEmail}
+
+	if err = s.enqueueMail(c, msg); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeProfilePage(c, http.StatusOK, "Please check "+newEmail+" for a confirmation link")
+}
+
+// handleGetConfirmEmailChangePage asks the user to confirm the change
+// with a button, so link scanners in mail clients can't make it for them.
+func (s *HTTPServer) handleGetConfirmEmailChangePage(c *gin.Context) {
+	token, exists := c.Params.Get("token")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	valid, err := s.dbPool.EmailChangeExists(c, hashOpaqueToken(token))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		mainTemplateSet.WriteTemplate(c,
+			http.StatusNotFound,
+			"login",
+			NewAlertMsg("This confirmation link is invalid or has expired"))
+		return
+	}
+
+	type ConfirmEmailChangePageData struct {
+		AlertMsg string
+		Token    string
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "confirm_email_change", &ConfirmEmailChangePageData{
+		Token: token,
+	})
+}
+
+func (s *HTTPServer) handleConfirmEmailChange(c *gin.Context) {
+	token, exists := c.Params.Get("token")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.dbPool.ConfirmEmailChange(c, hashOpaqueToken(token))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			mainTemplateSet.WriteTemplate(c,
+				http.StatusNotFound,
+				"login",
+				NewAlertMsg("This confirmation link is invalid or has expired"))
+			return
+		}
+
+		if errors.Is(err, db.EmailAlreadyRegisteredError) {
+			mainTemplateSet.WriteTemplate(c,
+				http.StatusBadRequest,
+				"login",
+				NewAlertMsg("Email already in use"))
+			return
+		}
+
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Anyone logged in under the old address is logged out, other than
+	// in this browser if it belongs to the user
+	session, err := s.confirmingSession(c, user.UUID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	keepSessionID := uuid.Nil
+	if session != nil {
+		keepSessionID = session.ID
+	}
+
+	if err = s.dbPool.RevokeUserSessions(c, user.UUID, keepSessionID); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// The access token carries the email, so it is swapped for a fresh one
+	if session != nil {
+		if err = s.issueAccessToken(c, user, session.ID, session.AuthenticatedAt); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	mainTemplateSet.WriteTemplate(c,
+		http.StatusOK,
+		"login",
+		NewAlertMsg("Your email is now "+user.Email+". Your other sessions have been logged out"))
+}
+
+// confirmingSession is the browser's session if it is logged in as the
+// user, or nil. Confirmation links are opened outside the dashboard, so
+// the session is read from the refresh token.
+func (s *HTTPServer) confirmingSession(c *gin.Context, userUUID uuid.UUID) (session *db.Session, err error) {
+	refreshTokenStr, err := s.cookie(c, "refresh_token")
+	if err != nil {
+		return nil, nil
+	}
+
+	refreshToken, err := ParseToken(refreshTokenStr, s.keyring)
+	if err != nil {
+		return nil, nil
+	}
+
+	claims := refreshToken.CustomClaims()
+	if claims.Type != JwtTokenTypeRefresh || claims.UserUUID != userUUID {
+		return nil, nil
+	}
+
+	return s.loadActiveSession(c, claims.SessionID, userUUID)
+}
@@ -0,0 +1,161 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recentAuthValidFor is how long after logging in or re-entering their
+// password a user can take sensitive actions without being asked again.
+const recentAuthValidFor = 5 * time.Minute
+
+// currentAuthTime is when the user last proved who they are in the
+// current session. Tokens from before this was tracked give the zero time.
+func (s *HTTPServer) currentAuthTime(c *gin.Context) time.Time {
+	authTime := s.getAccessTokenFromContext(c).CustomClaims().AuthTime
+	if authTime == nil {
+		return time.Time{}
+	}
+
+	return authTime.Time
+}
+
+// recentlyAuthenticated reports whether the user proved who they are
+// within recentAuthValidFor.
+func (s *HTTPServer) recentlyAuthenticated(c *gin.Context) bool {
+	return time.Since(s.currentAuthTime(c)) < recentAuthValidFor
+}
+
+// localRedirectPath returns next if it is a path on this site under /app,
+// and the dashboard otherwise, so re-authentication can't be used as an
+// open redirect.
+func localRedirectPath(next string) string {
+	nextURL, err := url.Parse(next)
+	if err != nil || nextURL.Scheme != "" || nextURL.Host != "" ||
+		!strings.HasPrefix(nextURL.Path, "/app/") || strings.Contains(next, "\\") {
+		return "/app/dashboard"
+	}
+
+	return nextURL.RequestURI()
+}
+
+// writeReauthPage asks the user for their password, and their second
+// factor if they have one, before carrying on to next.
+func (s *HTTPServer) writeReauthPage(c *gin.Context, status int, alertMsg string, next string) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type ReauthPageData struct {
+		AlertMsg    string
+		Next        string
+		TOTPEnabled bool
+	}
+
+	pageData := ReauthPageData{
+		AlertMsg:    alertMsg,
+		Next:        localRedirectPath(next),
+		TOTPEnabled: user.TOTPEnabled(),
+	}
+
+	mainTemplateSet.WriteTemplate(c, status, "reauth", &pageData)
+}
+
+// requireReauth stops the request and asks the user to prove who they are.
+func (s *HTTPServer) requireReauth(c *gin.Context, next string) {
+	s.writeReauthPage(c, http.StatusUnauthorized, "Please confirm your password to continue", next)
+	c.Abort()
+}
+
+// recentAuthMiddleware guards sensitive routes. It must run after
+// dashboardAuthMiddleware. A form that was posted has to be submitted
+// again afterwards, so the user is sent back to the page it came from.
+func (s *HTTPServer) recentAuthMiddleware(c *gin.Context) {
+	if s.recentlyAuthenticated(c) {
+		c.Next()
+		return
+	}
+
+	next := c.Request.URL.RequestURI()
+	if c.Request.Method != http.MethodGet {
+		next = "/app/dashboard"
+		if referer, err := url.Parse(c.Request.Referer()); err == nil {
+			next = referer.RequestURI()
+		}
+	}
+
+	s.requireReauth(c, next)
+}
+
+func (s *HTTPServer) handleGetReauthPage(c *gin.Context) {
+	s.writeReauthPage(c, http.StatusOK, "", c.Query("next"))
+}
+
+func (s *HTTPServer) handleReauthSubmit(c *gin.Context) {
+	next := c.PostForm("next")
+
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Guessing here counts towards the same lockout as the login page, so a
+	// stolen session can't be used to brute force the password
+	if retryAfter := loginRetryAfter(user); retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		s.writeReauthPage(c, http.StatusTooManyRequests, "Too many failed attempts. Please wait a moment and try again", next)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(c.PostForm("password"))) != nil {
+		if err = s.recordFailedLogin(c, user); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		s.writeReauthPage(c, http.StatusUnauthorized, "Password is incorrect", next)
+		return
+	}
+
+	if user.FailedLoginCount > 0 || user.LockedUntil != nil {
+		if err = s.dbPool.ClearFailedLogins(c, user.UUID); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if user.TOTPEnabled() {
+		ok, err := s.checkSecondFactor(c, user, c.PostForm("code"))
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			s.writeReauthPage(c, http.StatusUnauthorized, "Invalid code", next)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	sessionID := s.currentSessionID(c)
+
+	if err = s.dbPool.UpdateSessionAuthenticatedAt(c, sessionID, user.UUID, now); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.issueAccessToken(c, user, sessionID, now); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, localRedirectPath(next))
+}
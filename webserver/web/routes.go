@@ -9,36 +9,134 @@ func (s *HTTPServer) setupRoutes() (e *gin.Engine, err error) {
 	e = gin.New()
 	e.Use(gin.Recovery())
 	e.Use(gin.Logger())
+	e.Use(s.securityHeadersMiddleware)
+
+	// Client addresses are only taken from X-Forwarded-For and X-Real-IP
+	// when the request came through one of TRUSTED_PROXIES. With none set,
+	// the address of the connection is used.
+	trustedProxies, err := parseNetworkList(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return
+	}
+
+	var trustedProxyList []string
+	for _, proxy := range trustedProxies {
+		trustedProxyList = append(trustedProxyList, proxy.String())
+	}
+	if err = e.SetTrustedProxies(trustedProxyList); err != nil {
+		return
+	}
+
+	// API_ALLOWED_NETWORKS and ADMIN_ALLOWED_NETWORKS restrict where the
+	// device API and admin pages can be reached from
+	apiAllowedNetworks, err := parseNetworkList(os.Getenv("API_ALLOWED_NETWORKS"))
+	if err != nil {
+		return
+	}
+
+	adminAllowedNetworks, err := parseNetworkList(os.Getenv("ADMIN_ALLOWED_NETWORKS"))
+	if err != nil {
+		return
+	}
+
+	// Lets other services verify our tokens
+	e.GET("/.well-known/jwks.json", s.handleGetJWKS)
 
 	apiGroup := e.Group("/api")
 
 	accounts := make(gin.Accounts)
 	accounts[os.Getenv("ESP32_USERNAME")] = os.Getenv("ESP32_PASSWORD")
-	apiGroup.Use(gin.BasicAuth(accounts))
+	apiGroup.Use(ipAllowlistMiddleware(apiAllowedNetworks), s.deviceRateLimitMiddleware, gin.BasicAuth(accounts))
 
 	cardsGroup := apiGroup.Group("/cards")
 	cardsGroup.POST("/new", s.handleCreateCard)
 	cardsGroup.POST("/use", s.handleUseCardRequest)
 
+	devicesGroup := apiGroup.Group("/devices")
+	devicesGroup.POST("/heartbeat", s.handleDeviceHeartbeat)
+	devicesGroup.POST("/events", s.handleDeviceEvent)
+	devicesGroup.GET("/config", s.handleGetDeviceConfig)
+	devicesGroup.POST("/checkin", s.handleDeviceCheckIn)
+	devicesGroup.POST("/commands/:commandUUID/ack", s.handleAcknowledgeUnlockCommand)
+	devicesGroup.GET("/firmware/check", s.handleFirmwareCheck)
+	devicesGroup.GET("/firmware/:releaseUUID", s.handleDownloadFirmware)
+
 	appGroup := e.Group("/app")
+	appGroup.Use(s.csrfMiddleware)
 
 	appGroup.GET("/login", s.handleGetLoginPage)
-	appGroup.POST("/login", s.handleLoginSubmit)
+	appGroup.POST("/login", s.loginRateLimitMiddleware, s.handleLoginSubmit)
+	appGroup.POST("/login/totp", s.handleLoginTOTPSubmit)
+	appGroup.POST("/login/passkey/begin", s.handleBeginPasskeyLogin)
+	appGroup.POST("/login/passkey/finish", s.handleFinishPasskeyLogin)
 	appGroup.GET("/logout", s.handleGetLogout)
 	appGroup.GET("/confirmemail/:token", s.handleConfirmEmailPage)
+	appGroup.POST("/confirmemail/:token", s.handleConfirmEmailSubmit)
+	appGroup.GET("/confirmemailchange/:token", s.handleGetConfirmEmailChangePage)
+	appGroup.POST("/confirmemailchange/:token", s.handleConfirmEmailChange)
+	appGroup.GET("/forgotpassword", s.handleGetForgotPasswordPage)
+	appGroup.POST("/forgotpassword", s.passwordResetRateLimitMiddleware, s.handleForgotPasswordSubmit)
+	appGroup.GET("/resetpassword/:token", s.handleGetResetPasswordPage)
+	appGroup.POST("/resetpassword/:token", s.handleResetPasswordSubmit)
 
 	createAccountGroup := appGroup.Group("/createaccount")
 	createAccountGroup.GET("", s.handleGetCreateAccountPage)
-	createAccountGroup.POST("", s.handleCreateAccountSubmit).Use(s.createAccountRateLimitMiddleware)
+	createAccountGroup.POST("", s.createAccountRateLimitMiddleware, s.handleCreateAccountSubmit)
 
 	dashboardGroup := appGroup.Group("/dashboard")
 
 	dashboardGroup.Use(s.dashboardAuthMiddleware)
 	dashboardGroup.GET("", s.handleGetDashboardPage)
+	dashboardGroup.GET("/reauth", s.handleGetReauthPage)
+	dashboardGroup.POST("/reauth", s.handleReauthSubmit)
+	dashboardGroup.GET("/profile", s.handleGetProfilePage)
+	dashboardGroup.POST("/profile/name", s.handleUpdateProfileName)
+	dashboardGroup.POST("/profile/password", s.handleUpdateProfilePassword)
+	dashboardGroup.POST("/profile/email", s.handleUpdateProfileEmail)
+	dashboardGroup.GET("/2fa", s.handleGetTwoFactorPage)
+	dashboardGroup.POST("/2fa/enroll", s.handleStartTOTPEnrollment)
+	dashboardGroup.POST("/2fa/confirm", s.handleConfirmTOTPEnrollment)
+	dashboardGroup.POST("/2fa/recoverycodes", s.handleRegenerateRecoveryCodes)
+	dashboardGroup.POST("/2fa/disable", s.handleDisableTOTP)
+	dashboardGroup.GET("/passkeys", s.handleGetPasskeysPage)
+	dashboardGroup.POST("/passkeys/register/begin", s.recentAuthMiddleware, s.handleBeginPasskeyRegistration)
+	dashboardGroup.POST("/passkeys/register/finish", s.recentAuthMiddleware, s.handleFinishPasskeyRegistration)
+	dashboardGroup.POST("/passkeys/:passkeyID/delete", s.recentAuthMiddleware, s.handleDeletePasskey)
+	dashboardGroup.GET("/sessions", s.handleGetSessionsPage)
+	dashboardGroup.POST("/sessions/revokeothers", s.handleRevokeOtherSessions)
+	dashboardGroup.POST("/sessions/:sessionID/revoke", s.handleRevokeSession)
 	dashboardGroup.POST("/incrementopens/:cardUUID", s.handleDashboardIncrementOpens)
 	dashboardGroup.POST("/decrementopens/:cardUUID", s.handleDashboardDecrementOpens)
 	dashboardGroup.POST("/setopens/:cardUUID", s.handleDashboardSetOpens)
 	dashboardGroup.POST("/updatefriendlyname/:cardUUID", s.handleUpdateCardFriendyName)
+	dashboardGroup.GET("/devices/:deviceID", s.handleGetDevicePage)
+	dashboardGroup.POST("/devices/:deviceID/config", s.handleSetDeviceConfig)
+	dashboardGroup.POST("/devices/:deviceID/unlock", s.recentAuthMiddleware, s.handleDashboardUnlockDevice)
+	dashboardGroup.POST("/devices/:deviceID/claim", s.handleDashboardClaimDevice)
+	dashboardGroup.POST("/devices/:deviceID/alertsettings", s.handleDashboardSetAlertSettings)
+	dashboardGroup.POST("/alerts/:alertUUID/acknowledge", s.handleDashboardAcknowledgeAlert)
+	dashboardGroup.POST("/alerts/:alertUUID/resolve", s.handleDashboardResolveAlert)
+	dashboardGroup.GET("/firmware", s.handleGetFirmwarePage)
+
+	adminGroup := appGroup.Group("/admin")
+
+	adminGroup.Use(ipAllowlistMiddleware(adminAllowedNetworks), s.dashboardAuthMiddleware, s.adminAuthMiddleware)
+	adminGroup.GET("", s.handleGetAdminPage)
+	adminGroup.GET("/outbox", s.handleGetAdminOutboxPage)
+	adminGroup.POST("/outbox/:emailUUID/resend", s.handleAdminResendEmail)
+	adminGroup.GET("/security", s.handleGetAdminSecurityPage)
+	adminGroup.POST("/security", s.recentAuthMiddleware, s.handleSetAdminSecurity)
+	adminGroup.GET("/users", s.handleGetAdminUsersPage)
+	adminGroup.POST("/users/:userUUID/role", s.recentAuthMiddleware, s.handleSetUserRole)
+	adminGroup.POST("/users/:userUUID/unlock", s.recentAuthMiddleware, s.handleAdminUnlockUser)
+	adminGroup.GET("/keys", s.handleGetAdminKeysPage)
+	adminGroup.POST("/keys/rotate", s.recentAuthMiddleware, s.handleAdminRotateKey)
+	adminGroup.GET("/emails", s.handleGetAdminEmailsPage)
+	adminGroup.GET("/emails/:name", s.handleGetAdminEmailPreviewPage)
+	adminGroup.GET("/emails/:name/html", s.handleGetAdminEmailPreviewHTML)
+	adminGroup.POST("/firmware/upload", s.recentAuthMiddleware, s.handleUploadFirmware)
+	adminGroup.POST("/firmware/setrollout/:releaseUUID", s.recentAuthMiddleware, s.handleSetFirmwareRollout)
+	adminGroup.POST("/devices/:deviceID/pinfirmware", s.recentAuthMiddleware, s.handleSetDevicePinnedFirmware)
 
 	return
 }
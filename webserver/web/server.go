@@ -2,42 +2,134 @@ package web
 
 import (
 	"context"
-	"github.com/resend/resend-go/v2"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/sethvargo/go-limiter"
-	"github.com/sethvargo/go-limiter/memorystore"
 	"lockbox-webserver/db"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 type HTTPServer struct {
 	hostname string
 
-	dbPool       *db.Pool
-	jwtSecretKey []byte
-	resendClient *resend.Client
+	dbPool  *db.Pool
+	keyring *Keyring
+	mailer  Mailer
+
+	// webauthn runs passkey registration and login
+	webauthn *webauthn.WebAuthn
+	passkeys passkeyStore
+
+	cookies cookieConfig
+
+	// certs serves the TLS certificate when the server runs over HTTPS
+	certs *certReloader
+
+	// redirectAddr is where plain HTTP requests are redirected to HTTPS
+	// from, if anywhere
+	redirectAddr string
+
+	// firmwarePublicKey verifies uploaded firmware images when set
+	firmwarePublicKey ed25519.PublicKey
 
 	createAccountLimiter limiter.Store
+	loginLimiter         limiter.Store
+	passwordResetLimiter limiter.Store
+	totpLimiter          limiter.Store
+	deviceLimiter        limiter.Store
 }
 
 func NewHTTPServer(hostname string, dbPool *db.Pool, jwtSecretKey []byte) (server *HTTPServer, err error) {
-	createAccountLimiter, err := memorystore.New(&memorystore.Config{
-		Tokens:   1,
-		Interval: 15 * time.Minute,
-	})
+	// Limits are kept in the database so they hold across every server and
+	// through restarts
+	createAccountLimiter := dbPool.NewRateLimitStore("create_account", 1, 15*time.Minute)
+	loginLimiter := dbPool.NewRateLimitStore("login", 20, 15*time.Minute)
+	passwordResetLimiter := dbPool.NewRateLimitStore("password_reset", 3, 15*time.Minute)
+	totpLimiter := dbPool.NewRateLimitStore("totp", 5, 5*time.Minute)
+	deviceLimiter := dbPool.NewRateLimitStore("device", 120, time.Minute)
+
+	// New signing keys use JWT_SIGNING_ALGORITHM: HS256 (the default),
+	// EdDSA or ES256
+	signingAlgorithm := os.Getenv("JWT_SIGNING_ALGORITHM")
+	if signingAlgorithm == "" {
+		signingAlgorithm = "HS256"
+	}
+
+	keyring, err := NewKeyring(dbPool, signingAlgorithm, jwtSecretKey)
 	if err != nil {
 		return
 	}
 
-	resendClient := resend.NewClient(os.Getenv("RESEND_API_KEY"))
+	mailer, err := NewMailerFromEnv()
+	if err != nil {
+		return
+	}
+
+	webAuthn, err := newWebAuthn(hostname)
+	if err != nil {
+		return
+	}
+
+	cookies, err := newCookieConfigFromEnv(hostname)
+	if err != nil {
+		return
+	}
+
+	// TLS_CERT_FILE and TLS_KEY_FILE serve HTTPS rather than plain HTTP,
+	// and HTTP_REDIRECT_ADDR listens for plain HTTP to redirect
+	var certs *certReloader
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			err = errors.New("TLS needs both a certificate and a key file")
+			return
+		}
+
+		if certs, err = newCertReloader(certFile, keyFile); err != nil {
+			return
+		}
+	}
+
+	redirectAddr := os.Getenv("HTTP_REDIRECT_ADDR")
+	if redirectAddr != "" && !strings.HasPrefix(hostname, "https://") {
+		err = errors.New("redirecting to HTTPS needs an https:// hostname")
+		return
+	}
+
+	var firmwarePublicKey ed25519.PublicKey
+	if encodedKey := os.Getenv("FIRMWARE_SIGNING_PUBLIC_KEY"); encodedKey != "" {
+		if firmwarePublicKey, err = base64.StdEncoding.DecodeString(encodedKey); err != nil {
+			return
+		}
+
+		if len(firmwarePublicKey) != ed25519.PublicKeySize {
+			err = errors.New("invalid firmware signing public key")
+			return
+		}
+	}
 
 	server = &HTTPServer{
 		hostname:             hostname,
 		dbPool:               dbPool,
-		jwtSecretKey:         jwtSecretKey,
-		resendClient:         resendClient,
+		keyring:              keyring,
+		mailer:               mailer,
+		webauthn:             webAuthn,
+		passkeys:             dbPool,
+		cookies:              cookies,
+		certs:                certs,
+		redirectAddr:         redirectAddr,
+		firmwarePublicKey:    firmwarePublicKey,
 		createAccountLimiter: createAccountLimiter,
+		loginLimiter:         loginLimiter,
+		passwordResetLimiter: passwordResetLimiter,
+		totpLimiter:          totpLimiter,
+		deviceLimiter:        deviceLimiter,
 	}
 
 	return
@@ -50,20 +142,51 @@ func (s *HTTPServer) Run(ctx context.Context, addr string) (err error) {
 		return
 	}
 
-	// Spin up the server
+	// Tokens can't be signed until there's a key
+	s.maintainSigningKeys(ctx)
+	if s.keyring.ActiveKey() == nil {
+		return NoSigningKeyError
+	}
+
+	// Start background tasks. They stop along with the server.
+	go runPeriodically(ctx, signingKeyReloadInterval, s.maintainSigningKeys)
+	go runPeriodically(ctx, deviceAlertCheckInterval, s.checkDeviceAlerts)
+	go runPeriodically(ctx, outboxPollInterval, s.deliverOutbox)
+	go runPeriodically(ctx, expiredTokenCleanupInterval, s.cleanupExpiredTokens)
+
+	// Spin up the servers
 	srv := &http.Server{Addr: addr, Handler: ginEngine}
-	errChan := make(chan error)
-	go func() { errChan <- srv.ListenAndServe() }()
-
-	// Wait for a close event
-	for {
-		select {
-		case err := <-errChan:
-			return err
-		case <-ctx.Done():
-			srv.Shutdown(context.Background())
-			<-errChan
-			return nil
+	servers := []*http.Server{srv}
+	errChan := make(chan error, 2)
+
+	if s.certs != nil {
+		go runPeriodically(ctx, certReloadInterval, s.certs.reload)
+
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.certs.GetCertificate,
 		}
+		go func() { errChan <- srv.ListenAndServeTLS("", "") }()
+	} else {
+		go func() { errChan <- srv.ListenAndServe() }()
 	}
+
+	if s.redirectAddr != "" {
+		redirectSrv := &http.Server{Addr: s.redirectAddr, Handler: http.HandlerFunc(s.handleRedirectToHTTPS)}
+		servers = append(servers, redirectSrv)
+		go func() { errChan <- redirectSrv.ListenAndServe() }()
+	}
+
+	// Wait for a close event, or for either server to fail, then stop them
+	// all
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+	}
+
+	for _, server := range servers {
+		server.Shutdown(context.Background())
+	}
+
+	return
 }
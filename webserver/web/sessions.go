@@ -0,0 +1,84 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"lockbox-webserver/db"
+	"net/http"
+)
+
+func (s *HTTPServer) handleGetSessionsPage(c *gin.Context) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessions, err := s.dbPool.ListActiveSessions(c, user.UUID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type SessionsPageData struct {
+		AlertMsg         string
+		Sessions         []*db.Session
+		CurrentSessionID uuid.UUID
+	}
+
+	pageData := SessionsPageData{
+		Sessions:         sessions,
+		CurrentSessionID: s.currentSessionID(c),
+	}
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "sessions", &pageData)
+}
+
+func (s *HTTPServer) handleRevokeSession(c *gin.Context) {
+	sessionIDStr, exists := c.Params.Get("sessionID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	sessionID, err := uuid.Parse(sessionIDStr)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.RevokeSession(c, sessionID, user.UUID); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Revoking the current session is the same as logging out
+	if sessionID == s.currentSessionID(c) {
+		s.redirectToLogin(c)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/sessions")
+}
+
+// handleRevokeOtherSessions logs out everywhere except the current session.
+func (s *HTTPServer) handleRevokeOtherSessions(c *gin.Context) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.RevokeUserSessions(c, user.UUID, s.currentSessionID(c)); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/sessions")
+}
@@ -30,6 +30,13 @@ type HTMLTemplateSet struct {
 	templates map[string]*template.Template
 }
 
+// templateFuncs are available in every template. Those that depend on the
+// request are placeholders here, and are replaced in WriteTemplate.
+var templateFuncs = template.FuncMap{
+	"csrfToken": func() string { return "" },
+	"cspNonce":  func() string { return "" },
+}
+
 func NewHTMLTemplateSet(fs fs.ReadDirFS, path string, baseFile string) (templateSet *HTMLTemplateSet, err error) {
 	path = strings.TrimSuffix(path, "/")
 
@@ -47,7 +54,7 @@ func NewHTMLTemplateSet(fs fs.ReadDirFS, path string, baseFile string) (template
 			continue
 		}
 
-		t := template.Must(template.ParseFS(fs, path+"/"+baseFile, path+"/"+entry.Name()))
+		t := template.Must(template.New(baseFile).Funcs(templateFuncs).ParseFS(fs, path+"/"+baseFile, path+"/"+entry.Name()))
 		templateName, _ := strings.CutSuffix(entry.Name(), ".html")
 		templateSet.templates[templateName] = t
 	}
@@ -66,11 +73,24 @@ func (d *HTMLTemplateSet) LoadTemplate(key string) (t *template.Template, err er
 }
 
 func (d *HTMLTemplateSet) FormatTemplate(key string, data any) (buf bytes.Buffer, err error) {
+	return d.formatTemplate(key, data, nil)
+}
+
+// formatTemplate executes a template, overriding templateFuncs with funcs.
+func (d *HTMLTemplateSet) formatTemplate(key string, data any, funcs template.FuncMap) (buf bytes.Buffer, err error) {
 	t, err := d.LoadTemplate(key)
 	if err != nil {
 		return
 	}
 
+	// Templates are shared between requests, so a copy gets the funcs
+	if funcs != nil {
+		if t, err = t.Clone(); err != nil {
+			return
+		}
+		t.Funcs(funcs)
+	}
+
 	if err = t.Execute(&buf, data); err != nil {
 		return
 	}
@@ -78,8 +98,16 @@ func (d *HTMLTemplateSet) FormatTemplate(key string, data any) (buf bytes.Buffer
 	return
 }
 
+// WriteTemplate renders a template for the request, filling in its CSRF
+// token and CSP nonce.
 func (d *HTMLTemplateSet) WriteTemplate(c *gin.Context, httpStatus int, key string, data any) {
-	buf, err := d.FormatTemplate(key, data)
+	csrfToken := c.GetString(csrfTokenKey)
+	cspNonce := c.GetString(cspNonceKey)
+
+	buf, err := d.formatTemplate(key, data, template.FuncMap{
+		"csrfToken": func() string { return csrfToken },
+		"cspNonce":  func() string { return cspNonce },
+	})
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
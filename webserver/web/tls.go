@@ -0,0 +1,113 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the certificate files are checked for
+// changes, so renewed certificates are picked up without a restart.
+const certReloadInterval = time.Minute
+
+// certReloader serves the certificate in a pair of PEM files, reloading
+// it whenever either file changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (r *certReloader, err error) {
+	r = &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err = r.load(); err != nil {
+		return
+	}
+
+	return
+}
+
+// lastModified is when either file last changed.
+func (r *certReloader) lastModified() (modTime time.Time, err error) {
+	for _, name := range []string{r.certFile, r.keyFile} {
+		var info os.FileInfo
+		if info, err = os.Stat(name); err != nil {
+			return
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return
+}
+
+func (r *certReloader) load() (err error) {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	return
+}
+
+// reload loads the certificate again if its files have changed. The old
+// certificate is kept if the new one can't be loaded, as the files may be
+// halfway through being replaced.
+func (r *certReloader) reload(ctx context.Context) {
+	modTime, err := r.lastModified()
+	if err != nil {
+		log.Printf("tls: unable to check certificate: %v", err)
+		return
+	}
+
+	r.mu.RLock()
+	changed := !modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err = r.load(); err != nil {
+		log.Printf("tls: unable to reload certificate: %v", err)
+		return
+	}
+
+	log.Printf("tls: reloaded certificate from %s", r.certFile)
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// handleRedirectToHTTPS sends plain HTTP requests to the same page on the
+// site's HTTPS address.
+func (s *HTTPServer) handleRedirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, s.hostname+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
@@ -0,0 +1,395 @@
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
+	"lockbox-webserver/db"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTP parameters from RFC 6238, as understood by every authenticator
+	// app
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+
+	// totpSkew is how many steps either side of now are accepted, to allow
+	// for clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	// mfaChallengeValidFor is how long a user has to enter their code
+	// after their password was accepted
+	mfaChallengeValidFor = 5 * time.Minute
+)
+
+var totpSecretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code for a time step, per RFC 4226.
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// verifyTOTP checks code against the steps around now, returning the step
+// it matched.
+func verifyTOTP(secret []byte, code string, now time.Time) (step int64, ok bool) {
+	current := now.Unix() / int64(totpPeriod.Seconds())
+
+	for step = current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpQRCode renders the otpauth URI for secret as a PNG data URI for an
+// authenticator app to scan.
+func totpQRCode(email string, secret []byte) (dataURI template.URL, err error) {
+	label := url.PathEscape("Lockbox:" + email)
+	params := url.Values{
+		"secret":    {totpSecretEncoding.EncodeToString(secret)},
+		"issuer":    {"Lockbox"},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod.Seconds()))},
+	}
+
+	png, err := qrcode.Encode("otpauth://totp/"+label+"?"+params.Encode(), qrcode.Medium, 256)
+	if err != nil {
+		return
+	}
+
+	dataURI = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+
+	return
+}
+
+// newRecoveryCodes makes a fresh set of recovery codes along with the
+// hashes to store in their place.
+func newRecoveryCodes() (codes []string, hashes [][]byte, err error) {
+	for range recoveryCodeCount {
+		raw := make([]byte, 6)
+		if _, err = rand.Read(raw); err != nil {
+			return
+		}
+
+		code := strings.ToLower(totpSecretEncoding.EncodeToString(raw))
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashOpaqueToken(normalizeRecoveryCode(code)))
+	}
+
+	return
+}
+
+// normalizeRecoveryCode lets codes be typed with or without the dash and
+// in any case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+
+	return code
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused
+// recovery code. Attempts are rate limited per user.
+func (s *HTTPServer) checkSecondFactor(ctx context.Context, user *db.User, code string) (ok bool, err error) {
+	_, _, _, allowed, err := s.totpLimiter.Take(ctx, user.UUID.String())
+	if err != nil || !allowed {
+		return
+	}
+
+	code = strings.TrimSpace(code)
+
+	if len(code) == totpDigits {
+		step, valid := verifyTOTP(user.TOTPSecret, code, time.Now())
+		if !valid {
+			return
+		}
+
+		return s.dbPool.UseTOTPStep(ctx, user.UUID, step)
+	}
+
+	return s.dbPool.UseRecoveryCode(ctx, user.UUID, hashOpaqueToken(normalizeRecoveryCode(code)))
+}
+
+// startMFAChallenge asks for the second factor once the password has been
+// accepted. The user is remembered in a short-lived cookie until then.
+func (s *HTTPServer) startMFAChallenge(c *gin.Context, user *db.User, rememberMe bool) (err error) {
+	mfaToken, err := MakeToken(JwtCustomFields{
+		Type:       JwtTokenTypeMFA,
+		UserUUID:   user.UUID,
+		RememberMe: rememberMe,
+	}, mfaChallengeValidFor)
+	if err != nil {
+		return
+	}
+	mfaTokenStr, err := s.keyring.Sign(mfaToken)
+	if err != nil {
+		return
+	}
+
+	s.setCookie(c, "mfa_token", mfaTokenStr, int(mfaChallengeValidFor.Seconds()))
+
+	mainTemplateSet.WriteTemplate(c, http.StatusOK, "login_totp", nil)
+
+	return
+}
+
+func (s *HTTPServer) handleLoginTOTPSubmit(c *gin.Context) {
+	mfaTokenStr, err := s.cookie(c, "mfa_token")
+	if err != nil {
+		c.Redirect(http.StatusFound, "/app/login")
+		return
+	}
+
+	mfaToken, err := ParseToken(mfaTokenStr, s.keyring)
+	if err != nil || mfaToken.CustomClaims().Type != JwtTokenTypeMFA {
+		mainTemplateSet.WriteTemplate(c,
+			http.StatusUnauthorized,
+			"login",
+			NewAlertMsg("Your login has expired. Please try again"))
+		return
+	}
+
+	claims := mfaToken.CustomClaims()
+
+	user, err := s.dbPool.SelectUserByUUID(c, claims.UserUUID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := s.checkSecondFactor(c, user, c.PostForm("code"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		mainTemplateSet.WriteTemplate(c,
+			http.StatusUnauthorized,
+			"login_totp",
+			NewAlertMsg("Invalid code"))
+		return
+	}
+
+	s.clearCookie(c, "mfa_token")
+
+	if err = s.startSession(c, user, claims.RememberMe); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard")
+}
+
+func (s *HTTPServer) handleGetTwoFactorPage(c *gin.Context) {
+	s.writeTwoFactorPage(c, http.StatusOK, "", nil)
+}
+
+// writeTwoFactorPage shows the user's two-factor status. newRecoveryCodes
+// are shown this once and never again.
+func (s *HTTPServer) writeTwoFactorPage(c *gin.Context, status int, alertMsg string, newRecoveryCodes []string) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	type TwoFactorPageData struct {
+		AlertMsg          string
+		User              *db.User
+		RecoveryCodesLeft int
+		NewRecoveryCodes  []string
+		PendingQRCode     template.URL
+		PendingSecret     string
+	}
+
+	pageData := TwoFactorPageData{
+		AlertMsg:         alertMsg,
+		User:             user,
+		NewRecoveryCodes: newRecoveryCodes,
+	}
+
+	if user.TOTPEnabled() {
+		if pageData.RecoveryCodesLeft, err = s.dbPool.CountUnusedRecoveryCodes(c, user.UUID); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	} else if user.TOTPPendingSecret != nil {
+		if pageData.PendingQRCode, err = totpQRCode(user.Email, user.TOTPPendingSecret); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		pageData.PendingSecret = totpSecretEncoding.EncodeToString(user.TOTPPendingSecret)
+	}
+
+	mainTemplateSet.WriteTemplate(c, status, "two_factor", &pageData)
+}
+
+func (s *HTTPServer) handleStartTOTPEnrollment(c *gin.Context) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabled() {
+		s.writeTwoFactorPage(c, http.StatusBadRequest, "Two-factor authentication is already on", nil)
+		return
+	}
+
+	secret := make([]byte, 20)
+	if _, err = rand.Read(secret); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.SetUserPendingTOTPSecret(c, user.UUID, secret); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeTwoFactorPage(c, http.StatusOK, "", nil)
+}
+
+func (s *HTTPServer) handleConfirmTOTPEnrollment(c *gin.Context) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabled() || user.TOTPPendingSecret == nil {
+		c.Redirect(http.StatusFound, "/app/dashboard/2fa")
+		return
+	}
+
+	step, ok := verifyTOTP(user.TOTPPendingSecret, strings.TrimSpace(c.PostForm("code")), time.Now())
+	if !ok {
+		s.writeTwoFactorPage(c, http.StatusBadRequest, "Invalid code. Check your device's clock and try again", nil)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.EnableUserTOTP(c, user.UUID, step, hashes); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeTwoFactorPage(c, http.StatusOK, "Two-factor authentication is on", codes)
+}
+
+func (s *HTTPServer) handleRegenerateRecoveryCodes(c *gin.Context) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !user.TOTPEnabled() {
+		c.Redirect(http.StatusFound, "/app/dashboard/2fa")
+		return
+	}
+
+	ok, err := s.checkSecondFactor(c, user, c.PostForm("code"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.writeTwoFactorPage(c, http.StatusUnauthorized, "Invalid code", nil)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.dbPool.ReplaceRecoveryCodes(c, user.UUID, hashes); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeTwoFactorPage(c, http.StatusOK, "", codes)
+}
+
+func (s *HTTPServer) handleDisableTOTP(c *gin.Context) {
+	user, err := s.selectCurrentUser(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !user.TOTPEnabled() {
+		c.Redirect(http.StatusFound, "/app/dashboard/2fa")
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(c.PostForm("password"))) != nil {
+		s.writeTwoFactorPage(c, http.StatusUnauthorized, "Password is incorrect", nil)
+		return
+	}
+
+	ok, err := s.checkSecondFactor(c, user, c.PostForm("code"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.writeTwoFactorPage(c, http.StatusUnauthorized, "Invalid code", nil)
+		return
+	}
+
+	if err = s.dbPool.DisableUserTOTP(c, user.UUID); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeTwoFactorPage(c, http.StatusOK, "Two-factor authentication is off", nil)
+}
+
+// adminTOTPRequired reports whether admins must have two-factor
+// authentication on to use the admin pages.
+func (s *HTTPServer) adminTOTPRequired(ctx context.Context) (required bool, err error) {
+	value, err := s.dbPool.SelectSetting(ctx, db.SettingRequireAdminTOTP)
+	if err != nil {
+		return
+	}
+
+	required = value == "true"
+
+	return
+}
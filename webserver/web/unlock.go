@@ -0,0 +1,146 @@
+package web
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"lockbox-webserver/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// unlockPickupGrace is how long past its check-in interval a remote
+	// unlock is kept, to allow for the device connecting to WiFi and
+	// drifting while asleep.
+	unlockPickupGrace = 5 * time.Minute
+
+	// maxCheckInWait bounds how long a device check-in may long-poll.
+	maxCheckInWait = 25 * time.Second
+
+	checkInPollInterval = time.Second
+)
+
+func (s *HTTPServer) handleDashboardUnlockDevice(c *gin.Context) {
+	deviceID, exists := c.Params.Get("deviceID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	_, user := s.selectManagedDevice(c, deviceID)
+	if user == nil {
+		return
+	}
+
+	// A sleeping device only asks for commands when it next checks in, so
+	// the command has to last until then
+	config, err := s.loadDeviceConfig(c, deviceID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	validFor := config.CheckInInterval() + unlockPickupGrace
+
+	if _, err = s.dbPool.InsertUnlockCommand(c, deviceID, user.UUID, validFor); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/app/dashboard/devices/"+deviceID)
+}
+
+// handleDeviceCheckIn hands a device its next pending unlock command. If
+// none is pending it holds the request open for up to the requested number
+// of seconds, so a device that stays awake can long-poll.
+func (s *HTTPServer) handleDeviceCheckIn(c *gin.Context) {
+	type RequestBody struct {
+		DeviceID string `json:"device_id" binding:"required,max=64"`
+	}
+
+	reqBody := RequestBody{}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	waitSeconds, _ := strconv.Atoi(c.Query("wait"))
+	wait := min(time.Duration(max(waitSeconds, 0))*time.Second, maxCheckInWait)
+	deadline := time.Now().Add(wait)
+
+	var command *db.UnlockCommand
+	for {
+		var err error
+		command, err = s.dbPool.ClaimUnlockCommand(c, reqBody.DeviceID)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, pgx.ErrNoRows) {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(checkInPollInterval):
+		}
+	}
+
+	type ResponseBody struct {
+		CommandUUID uuid.UUID `json:"command_uuid"`
+		Command     string    `json:"command"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+
+	c.JSON(http.StatusOK, &ResponseBody{
+		CommandUUID: command.UUID,
+		Command:     "unlock",
+		ExpiresAt:   command.ExpiresAt,
+	})
+}
+
+func (s *HTTPServer) handleAcknowledgeUnlockCommand(c *gin.Context) {
+	commandUUIDStr, exists := c.Params.Get("commandUUID")
+	if !exists {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	commandUUID, err := uuid.Parse(commandUUIDStr)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	type RequestBody struct {
+		DeviceID string `json:"device_id" binding:"required,max=64"`
+		Result   string `json:"result" binding:"required,oneof=unlocked failed"`
+	}
+
+	reqBody := RequestBody{}
+	if err = c.BindJSON(&reqBody); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if err = s.dbPool.AcknowledgeUnlockCommand(c, reqBody.DeviceID, commandUUID, reqBody.Result); err != nil {
+		if errors.Is(err, db.UnlockCommandNotFoundError) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -1,5 +1,11 @@
 package web
 
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
 type AlertMsg struct {
 	AlertMsg string
 }
@@ -7,3 +13,22 @@ type AlertMsg struct {
 func NewAlertMsg(msg string) AlertMsg {
 	return AlertMsg{AlertMsg: msg}
 }
+
+// newOpaqueToken makes a random token to hand out in a link or cookie,
+// along with the hash to store in its place.
+func newOpaqueToken() (token string, hash []byte, err error) {
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	hash = hashOpaqueToken(token)
+
+	return
+}
+
+func hashOpaqueToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}